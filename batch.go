@@ -0,0 +1,231 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package edge_driver_go
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+//how batched samples are reported
+type BatchMode int
+
+const (
+	BatchSamples  BatchMode = iota //one message, each identifier carries a list of timestamped values, default
+	BatchMessages                  //several messages in order, each identifier appears once per message
+)
+
+//batch property report options, a flush is triggered by whichever limit is reached first
+type BatchOptions struct {
+	MaxSamples int           //flush when pending samples reach the count, no limit if 0
+	MaxBytes   int           //flush when approximate payload size reaches the bytes, no limit if 0
+	Interval   time.Duration //flush pending samples at interval after the first one is added, no limit if 0
+	Mode       BatchMode     //report mode
+}
+
+//approximate payload size of a sample besides identifier and value
+const batchSampleOverhead = 32
+
+type batchSample struct {
+	id    string
+	value ValueData
+}
+
+//accumulate property samples of end client and report them on flush
+type batcher struct {
+	opts    BatchOptions
+	report  func(ctx context.Context, samples []batchSample) error
+	logger  Logger
+	lock    sync.Mutex
+	samples []batchSample
+	size    int
+	timer   *time.Timer
+	flushMu sync.Mutex //keep flushed batches in order
+}
+
+func newBatcher(opts BatchOptions, report func(ctx context.Context, samples []batchSample) error, logger Logger) *batcher {
+	return &batcher{
+		opts:   opts,
+		report: report,
+		logger: logger,
+	}
+}
+
+//add samples, true if a limit is reached and the batch should be flushed
+func (b *batcher) add(params MetadataMsg) bool {
+	now := time.Now().UnixNano() / 1e6
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for k, v := range params {
+		if v.Time == 0 {
+			v.Time = now
+		}
+		buf, _ := json.Marshal(v.Value)
+		b.samples = append(b.samples, batchSample{id: k, value: v})
+		b.size += len(k) + len(buf) + batchSampleOverhead
+	}
+	if len(b.samples) == 0 {
+		return false
+	}
+	if (b.opts.MaxSamples > 0 && len(b.samples) >= b.opts.MaxSamples) || (b.opts.MaxBytes > 0 && b.size >= b.opts.MaxBytes) {
+		return true
+	}
+	if b.opts.Interval > 0 && b.timer == nil {
+		b.timer = time.AfterFunc(b.opts.Interval, func() {
+			if err := b.flush(context.Background()); err != nil && b.logger != nil {
+				b.logger.Warn("[sdk] batch report failed:", err.Error())
+			}
+		})
+	}
+	return false
+}
+
+//take pending samples and reset batch
+func (b *batcher) take() []batchSample {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	samples := b.samples
+	b.samples = nil
+	b.size = 0
+	return samples
+}
+
+//report pending samples, samples are dropped if report fails
+func (b *batcher) flush(ctx context.Context) error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+	samples := b.take()
+	if len(samples) == 0 {
+		return nil
+	}
+	return b.report(ctx, samples)
+}
+
+//split samples into messages, a new message is started when the identifier already exists
+func splitSamples(samples []batchSample) []MetadataMsg {
+	var (
+		result  []MetadataMsg
+		current MetadataMsg
+	)
+	for _, s := range samples {
+		if current == nil {
+			current = make(MetadataMsg)
+		} else if _, ok := current[s.id]; ok {
+			result = append(result, current)
+			current = make(MetadataMsg)
+		}
+		current[s.id] = s.value
+	}
+	if current != nil {
+		result = append(result, current)
+	}
+	return result
+}
+
+//queue property samples, they are reported when a batch limit is reached, on Flush or Close.
+//samples are reported immediately if batch report is not enabled
+func (e *endClient) ReportPropertiesBatch(ctx context.Context, params MetadataMsg) error {
+	if e.batch == nil {
+		return e.ReportPropertiesWithTagsEx(ctx, params, nil)
+	}
+	ctx, receipt := newDelivery(ctx)
+	done := wait(func() error {
+		var (
+			ok  bool
+			err error
+		)
+		if params, err = e.validate.validatePropertiesEx(ctx, e.config.DeviceId(), params); err != nil {
+			return err
+		}
+		if params, ok = e.changedPropertiesEx(params); !ok {
+			return nil
+		}
+		if e.batch.add(params) {
+			return e.batch.flush(ctx)
+		}
+		return nil
+	})
+	select {
+	case err := <-done:
+		receipt.fill()
+		return err
+	case <-ctx.Done():
+		receipt.fill()
+		return ErrPublishTimeout
+	}
+}
+
+//report pending samples now
+func (e *endClient) Flush(ctx context.Context) error {
+	if e.batch == nil {
+		return nil
+	}
+	ctx, receipt := newDelivery(ctx)
+	done := wait(func() error {
+		return e.batch.flush(ctx)
+	})
+	select {
+	case err := <-done:
+		receipt.fill()
+		return err
+	case <-ctx.Done():
+		receipt.fill()
+		return ErrPublishTimeout
+	}
+}
+
+//report samples by batch mode, the first error is returned.
+//values are remembered for report on change only after they are reported
+func (e *endClient) reportBatch(ctx context.Context, samples []batchSample) error {
+	var (
+		msg      message
+		payloads [][]byte
+		values   []Metadata
+		result   error
+	)
+	topic := msg.buildPropertyTopic(e.config.DeviceId(), e.config.ThingId())
+	if e.batch.opts.Mode == BatchMessages {
+		for _, params := range splitSamples(samples) {
+			payloads = append(payloads, msg.buildPropertyMsgWithTagsEx(e.config.DeviceId(), e.config.ThingId(), params, nil))
+			values = append(values, msgValues(params))
+		}
+	} else {
+		params := make(map[string][]property)
+		last := make(Metadata)
+		for _, s := range samples {
+			params[s.id] = append(params[s.id], property{Value: s.value.Value, Time: s.value.Time})
+			last[s.id] = s.value.Value
+		}
+		payloads = append(payloads, msg.buildPropertyBatchMsg(e.config.DeviceId(), e.config.ThingId(), params, nil))
+		values = append(values, last)
+	}
+	for i, data := range payloads {
+		if err := e.session.report(ctx, topic, data, e.policy(PropertyMessage)); err != nil {
+			if result == nil {
+				result = err
+			}
+			continue
+		}
+		e.commitProperties(values[i])
+	}
+	return result
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package edge_driver_go
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func batchParams(t *testing.T, m *fakeMessage) map[string]json.RawMessage {
+	var msg struct {
+		Params map[string]json.RawMessage `json:"params"`
+	}
+	assert.Nil(t, json.Unmarshal(m.payload, &msg))
+	return msg.Params
+}
+
+func TestBatchReport(t *testing.T) {
+	client, fake, ctx, done := newTestClient(t, SetBatchReport(BatchOptions{MaxSamples: 3}))
+	defer done()
+
+	assert.Nil(t, client.ReportPropertiesBatch(ctx, MetadataMsg{"temp": {Value: 20, Time: 1}}))
+	assert.Nil(t, client.ReportPropertiesBatch(ctx, MetadataMsg{"temp": {Value: 21, Time: 2}}))
+	assert.Len(t, fake.messages(), 0)
+	assert.Nil(t, client.ReportPropertiesBatch(ctx, MetadataMsg{"temp": {Value: 22, Time: 3}}))
+	messages := fake.messages()
+	assert.Len(t, messages, 1)
+	assert.JSONEq(t, `[{"value":20,"time":1},{"value":21,"time":2},{"value":22,"time":3}]`,
+		string(batchParams(t, messages[0])["temp"]))
+
+	//pending samples are reported on close
+	assert.Nil(t, client.ReportPropertiesBatch(ctx, MetadataMsg{"temp": {Value: 23, Time: 4}}))
+	assert.Nil(t, client.Close(ctx))
+	messages = fake.messages()
+	assert.Len(t, messages, 2)
+	assert.JSONEq(t, `[{"value":23,"time":4}]`, string(batchParams(t, messages[1])["temp"]))
+}
+
+func TestBatchReportOnChange(t *testing.T) {
+	client, fake, ctx, done := newTestClient(t, SetBatchReport(BatchOptions{MaxSamples: 1}), SetReportOnChange(ChangeFilter{}, nil))
+	defer done()
+
+	//value of failed report is not remembered
+	fake.lock.Lock()
+	fake.publishErr = errors.New("not authorized")
+	fake.lock.Unlock()
+	assert.NotNil(t, client.ReportPropertiesBatch(ctx, MetadataMsg{"temp": {Value: 20, Time: 1}}))
+	fake.lock.Lock()
+	fake.publishErr = nil
+	fake.lock.Unlock()
+	published := len(fake.messages())
+	assert.Nil(t, client.ReportPropertiesBatch(ctx, MetadataMsg{"temp": {Value: 20, Time: 2}}))
+	assert.Len(t, fake.messages(), published+1)
+	assert.Nil(t, client.ReportPropertiesBatch(ctx, MetadataMsg{"temp": {Value: 20, Time: 3}}))
+	assert.Len(t, fake.messages(), published+1)
+}
+
+func TestBatchMessages(t *testing.T) {
+	client, fake, ctx, done := newTestClient(t, SetBatchReport(BatchOptions{Interval: 50 * time.Millisecond, Mode: BatchMessages}))
+	defer done()
+
+	assert.Nil(t, client.ReportPropertiesBatch(ctx, MetadataMsg{"temp": {Value: 20, Time: 1}, "name": {Value: "a", Time: 1}}))
+	assert.Nil(t, client.ReportPropertiesBatch(ctx, MetadataMsg{"temp": {Value: 21, Time: 2}}))
+	assert.Len(t, fake.messages(), 0)
+	time.Sleep(150 * time.Millisecond)
+	messages := fake.messages()
+	assert.Len(t, messages, 2)
+	assert.JSONEq(t, `{"temp":{"value":20,"time":1},"name":{"value":"a","time":1}}`, mustMarshal(t, batchParams(t, messages[0])))
+	assert.JSONEq(t, `{"temp":{"value":21,"time":2}}`, mustMarshal(t, batchParams(t, messages[1])))
+	assert.Nil(t, client.Flush(ctx))
+	assert.Len(t, fake.messages(), 2)
+}
+
+func TestBatchMaxBytes(t *testing.T) {
+	var reported [][]batchSample
+	b := newBatcher(BatchOptions{MaxBytes: 100}, func(ctx context.Context, samples []batchSample) error {
+		reported = append(reported, samples)
+		return nil
+	}, nil)
+	assert.False(t, b.add(MetadataMsg{"name": {Value: "abc"}}))
+	assert.True(t, b.add(MetadataMsg{"name": {Value: "abcdefghijklmnopqrstuvwxyz"}}))
+	assert.Nil(t, b.flush(context.Background()))
+	assert.Len(t, reported, 1)
+	assert.Len(t, reported[0], 2)
+	assert.NotZero(t, reported[0][0].value.Time)
+}
+
+func mustMarshal(t *testing.T, v interface{}) string {
+	buf, err := json.Marshal(v)
+	assert.Nil(t, err)
+	return string(buf)
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package edge_driver_go
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+//property ext keys of report filter, max silence is in seconds
+const (
+	extDeadbandKey        = "deadband"
+	extDeadbandPercentKey = "deadband_percent"
+	extMaxSilenceKey      = "max_silence"
+)
+
+//report filter of property, a value is reported when it changed beyond deadband or max silence elapsed
+type ChangeFilter struct {
+	Deadband        float64       //numeric change within the absolute deadband is not reported
+	DeadbandPercent float64       //numeric change within the percent of last reported value is not reported
+	MaxSilence      time.Duration //value is reported anyway if the property is not reported for the duration, no limit if 0
+}
+
+type lastReport struct {
+	value interface{}
+	at    time.Time
+}
+
+//remember last reported value of each property and drop values not changed
+type changeFilter struct {
+	defaults ChangeFilter            //filter of properties not in filters and without ext settings
+	filters  map[string]ChangeFilter //filter of property identifier, override ext settings
+	lock     sync.Mutex
+	last     map[string]*lastReport
+}
+
+func newChangeFilter(defaults ChangeFilter, filters map[string]ChangeFilter) *changeFilter {
+	f := &changeFilter{
+		defaults: defaults,
+		filters:  make(map[string]ChangeFilter, len(filters)),
+		last:     make(map[string]*lastReport),
+	}
+	for k, v := range filters {
+		f.filters[k] = v
+	}
+	return f
+}
+
+//filter setting of property, thing model may be nil
+func (f *changeFilter) setting(thing *ThingModel, id string) ChangeFilter {
+	if setting, ok := f.filters[id]; ok {
+		return setting
+	}
+	setting := f.defaults
+	if thing == nil || thing.Properties[id] == nil {
+		return setting
+	}
+	ext := thing.Properties[id].Ext
+	if v, ok := defineNumber(ext, extDeadbandKey); ok {
+		setting.Deadband = v
+	}
+	if v, ok := defineNumber(ext, extDeadbandPercentKey); ok {
+		setting.DeadbandPercent = v
+	}
+	if v, ok := defineNumber(ext, extMaxSilenceKey); ok {
+		setting.MaxSilence = time.Duration(v * float64(time.Second))
+	}
+	return setting
+}
+
+//check if value of property should be reported
+func (f *changeFilter) changed(thing *ThingModel, id string, value interface{}, now time.Time) bool {
+	f.lock.Lock()
+	last := f.last[id]
+	f.lock.Unlock()
+	if last == nil {
+		return true
+	}
+	setting := f.setting(thing, id)
+	if setting.MaxSilence > 0 && now.Sub(last.at) >= setting.MaxSilence {
+		return true
+	}
+	if isNumericProperty(thing, id) {
+		current, ok := toNumber(value, false)
+		previous, lastOk := toNumber(last.value, false)
+		if ok && lastOk {
+			delta := math.Abs(current - previous)
+			if delta == 0 || delta <= setting.Deadband {
+				return false
+			}
+			if setting.DeadbandPercent > 0 && delta <= math.Abs(previous)*setting.DeadbandPercent/100 {
+				return false
+			}
+			return true
+		}
+	}
+	return !reflect.DeepEqual(value, last.value)
+}
+
+//drop properties not changed
+func (f *changeFilter) filter(thing *ThingModel, params Metadata) Metadata {
+	now := time.Now()
+	result := make(Metadata, len(params))
+	for k, v := range params {
+		if f.changed(thing, k, v, now) {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+//remember reported values
+func (f *changeFilter) commit(params Metadata) {
+	now := time.Now()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for k, v := range params {
+		f.last[k] = &lastReport{value: v, at: now}
+	}
+}
+
+//numeric property of thing model, any numeric value is compared by deadband if the model is unknown
+func isNumericProperty(thing *ThingModel, id string) bool {
+	if thing == nil || thing.Properties[id] == nil {
+		return true
+	}
+	switch strings.ToUpper(thing.Properties[id].Type) {
+	case "INT32", "FLOAT", "DOUBLE":
+		return true
+	}
+	return false
+}
+
+//drop properties not changed since last report, false if there is nothing left to report
+func (e *endClient) changedProperties(params Metadata) (Metadata, bool) {
+	if e.changes == nil || len(params) == 0 {
+		return params, true
+	}
+	thing, _ := e.session.getModel(e.config.DeviceId())
+	params = e.changes.filter(thing, params)
+	return params, len(params) > 0
+}
+
+func (e *endClient) changedPropertiesEx(params MetadataMsg) (MetadataMsg, bool) {
+	if e.changes == nil || len(params) == 0 {
+		return params, true
+	}
+	values, ok := e.changedProperties(msgValues(params))
+	result := make(MetadataMsg, len(values))
+	for k := range values {
+		result[k] = params[k]
+	}
+	return result, ok
+}
+
+//remember reported properties for report on change
+func (e *endClient) commitProperties(params Metadata) {
+	if e.changes != nil {
+		e.changes.commit(params)
+	}
+}
+
+func msgValues(params MetadataMsg) Metadata {
+	values := make(Metadata, len(params))
+	for k, v := range params {
+		values[k] = v.Value
+	}
+	return values
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package edge_driver_go
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestChangeFilter(t *testing.T) {
+	thing := newThingModel()
+	thing.Properties["temp"] = &Property{Identifier: "temp", Type: "FLOAT", Ext: map[string]interface{}{"deadband": "0.5"}}
+	thing.Properties["mode"] = &Property{Identifier: "mode", Type: "ENUM"}
+	f := newChangeFilter(ChangeFilter{}, map[string]ChangeFilter{
+		"humidity": {DeadbandPercent: 10, MaxSilence: 50 * time.Millisecond},
+	})
+	f.commit(Metadata{"temp": 20.0, "mode": 1, "humidity": 50, "name": "a"})
+	now := time.Now()
+
+	assert.False(t, f.changed(thing, "temp", 20.4, now))
+	assert.True(t, f.changed(thing, "temp", 20.6, now))
+	assert.False(t, f.changed(thing, "mode", 1, now))
+	assert.True(t, f.changed(thing, "mode", 2, now))
+	assert.False(t, f.changed(thing, "humidity", 54, now))
+	assert.True(t, f.changed(thing, "humidity", 56, now))
+	assert.True(t, f.changed(thing, "humidity", 50, now.Add(50*time.Millisecond)))
+	assert.False(t, f.changed(thing, "name", "a", now))
+	assert.True(t, f.changed(thing, "unknown", 1, now))
+	assert.Equal(t, Metadata{"temp": 21.0}, f.filter(thing, Metadata{"temp": 21.0, "mode": 1}))
+}
+
+func TestReportOnChange(t *testing.T) {
+	client, fake, ctx, done := newTestClient(t, SetReportOnChange(ChangeFilter{Deadband: 2}, nil))
+	defer done()
+
+	assert.Nil(t, client.ReportProperties(ctx, Metadata{"temp": 20}))
+	assert.Nil(t, client.ReportProperties(ctx, Metadata{"temp": 21}))
+	assert.Nil(t, client.ReportPropertiesWithTagsEx(ctx, MetadataMsg{"temp": {Value: 22, Time: 1}}, nil))
+	assert.Nil(t, client.ReportProperties(ctx, Metadata{"temp": 23}))
+	assert.Len(t, fake.messages(), 2)
+}
@@ -15,35 +15,64 @@
  */
 package edge_driver_go
 
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
 type deviceConfig struct {
-	metadata map[string]interface{}
-	services []string
-	deviceId string
-	thingId  string
-	token    string
+	sync.RWMutex
+	metadata  map[string]interface{}
+	services  []string
+	deviceId  string
+	thingId   string
+	token     string
+	expiresAt time.Time
 }
 
-func newDeviceConfig(token string) (config, error) {
+func newDeviceConfig(token string, keyFunc TokenKeyFunc) (config, error) {
 	var (
-		deviceId string
-		thingId  string
-		conf     config
-		err      error
+		info *tokenInfo
+		conf config
+		err  error
 	)
-	if deviceId, thingId, err = parseToken(token); err != nil {
+	if info, err = parseToken(token, keyFunc); err != nil {
 		return nil, err
 	}
 	//need get services
 	conf = &deviceConfig{
-		deviceId: deviceId,
-		thingId:  thingId,
+		deviceId:  info.deviceId,
+		thingId:   info.thingId,
+		token:     token,
+		expiresAt: info.expiresAt,
 	}
 	return conf, nil
 }
 func (c *deviceConfig) Token() string {
+	c.RLock()
+	defer c.RUnlock()
 	return c.token
 }
-func (c *deviceConfig) update() error {
+func (c *deviceConfig) ExpiresAt() time.Time {
+	c.RLock()
+	defer c.RUnlock()
+	return c.expiresAt
+}
+
+//update token, device id and thing id can't be changed
+func (c *deviceConfig) update(token string, keyFunc TokenKeyFunc) error {
+	info, err := parseToken(token, keyFunc)
+	if err != nil {
+		return err
+	}
+	if info.deviceId != c.deviceId || info.thingId != c.thingId {
+		return &TokenError{Reason: TokenMalformed, Err: errors.New("token device changed")}
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.token = token
+	c.expiresAt = info.expiresAt
 	return nil
 }
 func (c *deviceConfig) DeviceId() string {
@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package edge_driver_go
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+//hub credentials provider, called before every connect
+type CredentialsFunc func() (username string, password string, err error)
+
+//hub tls options, file paths are PEM encoded
+type TLSOptions struct {
+	CAFile             string //ca bundle to verify hub certificate
+	CertFile           string //client certificate
+	KeyFile            string //client certificate key
+	ServerName         string //override server name used to verify hub certificate
+	InsecureSkipVerify bool   //skip hub certificate verify, only for debug
+}
+
+//fixed username and password
+func StaticCredentials(username, password string) CredentialsFunc {
+	return func() (string, string, error) {
+		return username, password, nil
+	}
+}
+
+//password is read from file on every connect, so it can be rotated
+func FileCredentials(username, passwordFile string) CredentialsFunc {
+	return func() (string, string, error) {
+		content, err := ioutil.ReadFile(passwordFile)
+		if err != nil {
+			return "", "", err
+		}
+		return username, strings.TrimSpace(string(content)), nil
+	}
+}
+
+//sub device token credentials, username is the device id in token and password is the token
+func TokenCredentials(token string) CredentialsFunc {
+	return func() (string, string, error) {
+		info, err := parseToken(token, nil)
+		if err != nil {
+			return "", "", err
+		}
+		return info.deviceId, token, nil
+	}
+}
+
+func (o TLSOptions) enabled() bool {
+	return o.CAFile != "" || o.CertFile != "" || o.KeyFile != "" || o.ServerName != "" || o.InsecureSkipVerify
+}
+
+//build tls config from options
+func (o TLSOptions) config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	if o.CAFile != "" {
+		content, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, errors.New("no certificate found in ca file " + o.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+//paho supports ssl, tls and tcps for tls connection
+func normalizeBroker(address string) string {
+	if strings.HasPrefix(address, "mqtts://") {
+		return "ssl://" + strings.TrimPrefix(address, "mqtts://")
+	}
+	if strings.HasPrefix(address, "mqtt://") {
+		return "tcp://" + strings.TrimPrefix(address, "mqtt://")
+	}
+	return address
+}
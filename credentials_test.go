@@ -0,0 +1,54 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package edge_driver_go
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFileCredentials(t *testing.T) {
+	f, err := ioutil.TempFile("", "edge-password")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("secret\n")
+	f.Close()
+	username, password, err := FileCredentials("driver", f.Name())()
+	assert.Nil(t, err)
+	assert.Equal(t, "driver", username)
+	assert.Equal(t, "secret", password)
+	_, _, err = FileCredentials("driver", f.Name()+".none")()
+	assert.NotNil(t, err)
+}
+func TestNormalizeBroker(t *testing.T) {
+	assert.Equal(t, "ssl://127.0.0.1:8883", normalizeBroker("mqtts://127.0.0.1:8883"))
+	assert.Equal(t, "tcp://127.0.0.1:1883", normalizeBroker("mqtt://127.0.0.1:1883"))
+	assert.Equal(t, "ssl://127.0.0.1:8883", normalizeBroker("ssl://127.0.0.1:8883"))
+}
+func TestSessionTLS(t *testing.T) {
+	os.Setenv("EDGE_HUB_HOST", "")
+	s, err := NewSession(SetDriverId("driver"), SetEdgeDevice("iotd-edge", "iott-edge"),
+		SetHubTLS(TLSOptions{ServerName: "hub.local"}))
+	assert.Nil(t, err)
+	assert.Equal(t, hubTLSBroker, s.hubAddress)
+	assert.Equal(t, "hub.local", s.tlsConfig.ServerName)
+	_, err = NewSession(SetDriverId("driver"), SetEdgeDevice("iotd-edge", "iott-edge"),
+		SetHubTLS(TLSOptions{CAFile: "/none/ca.pem"}))
+	assert.NotNil(t, err)
+}
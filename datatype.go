@@ -0,0 +1,413 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package edge_driver_go
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+//thing model define keys
+const (
+	defineMinKey    = "min"
+	defineMaxKey    = "max"
+	defineStepKey   = "step"
+	defineLengthKey = "length" //max length of string
+	defineEnumKey   = "enum"   //enum values, a map of value to name or a list of values
+	defineSizeKey   = "size"   //max item count of array
+	defineItemKey   = "item"   //item type of array
+	defineFieldsKey = "fields" //fields of struct
+)
+
+//check value against thing model type and define, the value may be converted when coerce is set
+func checkValue(path string, typ string, define map[string]interface{}, value interface{}, coerce bool) (interface{}, *FieldError) {
+	var (
+		result interface{}
+		reason string
+	)
+	switch strings.ToUpper(typ) {
+	case "INT32":
+		result, reason = checkInt32(define, value, coerce)
+	case "FLOAT":
+		result, reason = checkFloat(define, value, coerce, math.MaxFloat32)
+	case "DOUBLE":
+		result, reason = checkFloat(define, value, coerce, math.MaxFloat64)
+	case "STRING":
+		result, reason = checkString(define, value, coerce)
+	case "ENUM":
+		result, reason = checkEnum(define, value, coerce)
+	case "BOOL":
+		result, reason = checkBool(value, coerce)
+	case "DATE":
+		result, reason = checkDate(value, coerce)
+	case "ARRAY":
+		return checkArray(path, define, value, coerce)
+	case "STRUCT":
+		return checkStruct(path, define, value, coerce)
+	default:
+		//unknown type is not checked
+		return value, nil
+	}
+	if reason != "" {
+		return nil, &FieldError{Field: path, Reason: reason, Value: value}
+	}
+	return result, nil
+}
+
+//convert value to float64, strings are accepted when coerce is set
+func toNumber(value interface{}, coerce bool) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		if !coerce {
+			return 0, false
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	case bool:
+		if !coerce {
+			return 0, false
+		}
+		if v {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+//get define value by key
+func defineValue(define map[string]interface{}, key string) (interface{}, bool) {
+	if v, ok := define[key]; ok && v != nil {
+		return v, true
+	}
+	return nil, false
+}
+
+//get numeric define value, numbers may be written as strings
+func defineNumber(define map[string]interface{}, key string) (float64, bool) {
+	v, ok := defineValue(define, key)
+	if !ok {
+		return 0, false
+	}
+	if s, isString := v.(string); isString && strings.TrimSpace(s) == "" {
+		return 0, false
+	}
+	return toNumber(v, true)
+}
+
+//check min, max and step
+func checkRange(define map[string]interface{}, f float64) string {
+	min, hasMin := defineNumber(define, defineMinKey)
+	if hasMin && f < min {
+		return fmt.Sprintf("less than min %v", min)
+	}
+	if max, ok := defineNumber(define, defineMaxKey); ok && f > max {
+		return fmt.Sprintf("greater than max %v", max)
+	}
+	if step, ok := defineNumber(define, defineStepKey); ok && step > 0 {
+		n := (f - min) / step
+		if math.Abs(n-math.Round(n)) > 1e-6 {
+			return fmt.Sprintf("not a multiple of step %v", step)
+		}
+	}
+	return ""
+}
+
+func checkInt32(define map[string]interface{}, value interface{}, coerce bool) (interface{}, string) {
+	f, ok := toNumber(value, coerce)
+	if !ok {
+		return nil, "not a number"
+	}
+	if f != math.Trunc(f) {
+		return nil, "not an integer"
+	}
+	if f < math.MinInt32 || f > math.MaxInt32 {
+		return nil, "out of int32 range"
+	}
+	if reason := checkRange(define, f); reason != "" {
+		return nil, reason
+	}
+	if coerce {
+		return int32(f), ""
+	}
+	return value, ""
+}
+
+func checkFloat(define map[string]interface{}, value interface{}, coerce bool, limit float64) (interface{}, string) {
+	f, ok := toNumber(value, coerce)
+	if !ok {
+		return nil, "not a number"
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) || math.Abs(f) > limit {
+		return nil, "out of range"
+	}
+	if reason := checkRange(define, f); reason != "" {
+		return nil, reason
+	}
+	if coerce {
+		return f, ""
+	}
+	return value, ""
+}
+
+func checkString(define map[string]interface{}, value interface{}, coerce bool) (interface{}, string) {
+	s, ok := value.(string)
+	if !ok {
+		if !coerce {
+			return nil, "not a string"
+		}
+		switch value.(type) {
+		case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, json.Number:
+			s = fmt.Sprint(value)
+		default:
+			return nil, "not a string"
+		}
+	}
+	if length, ok := defineNumber(define, defineLengthKey); ok && length > 0 && float64(utf8.RuneCountInString(s)) > length {
+		return nil, fmt.Sprintf("longer than %v", length)
+	}
+	if coerce {
+		return s, ""
+	}
+	return value, ""
+}
+
+func checkEnum(define map[string]interface{}, value interface{}, coerce bool) (interface{}, string) {
+	var key string
+	switch v := value.(type) {
+	case string:
+		key = v
+	default:
+		f, ok := toNumber(value, false)
+		if !ok || f != math.Trunc(f) {
+			return nil, "not an enum value"
+		}
+		key = strconv.FormatInt(int64(f), 10)
+	}
+	enums, ok := defineValue(define, defineEnumKey)
+	if !ok {
+		return value, ""
+	}
+	found := false
+	switch e := enums.(type) {
+	case map[string]interface{}:
+		_, found = e[key]
+	case []interface{}:
+		for _, item := range e {
+			if fmt.Sprint(item) == key {
+				found = true
+				break
+			}
+		}
+	default:
+		return value, ""
+	}
+	if !found {
+		return nil, "not in enum values"
+	}
+	if coerce {
+		if i, err := strconv.ParseInt(key, 10, 64); err == nil {
+			return i, ""
+		}
+	}
+	return value, ""
+}
+
+func checkBool(value interface{}, coerce bool) (interface{}, string) {
+	if _, ok := value.(bool); ok {
+		return value, ""
+	}
+	if coerce {
+		if s, ok := value.(string); ok {
+			if b, err := strconv.ParseBool(strings.TrimSpace(s)); err == nil {
+				return b, ""
+			}
+		}
+		if f, ok := toNumber(value, false); ok && (f == 0 || f == 1) {
+			return f == 1, ""
+		}
+	}
+	return nil, "not a bool"
+}
+
+//date is a timestamp in milliseconds
+func checkDate(value interface{}, coerce bool) (interface{}, string) {
+	if f, ok := toNumber(value, false); ok {
+		if f != math.Trunc(f) || f < 0 {
+			return nil, "not a timestamp"
+		}
+		if coerce {
+			return int64(f), ""
+		}
+		return value, ""
+	}
+	if s, ok := value.(string); ok && coerce {
+		if i, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64); err == nil && i >= 0 {
+			return i, ""
+		}
+		if t, err := time.Parse(time.RFC3339, strings.TrimSpace(s)); err == nil {
+			return t.UnixNano() / 1e6, ""
+		}
+	}
+	return nil, "not a timestamp"
+}
+
+//item type of array define, a type name or a define object with type
+func arrayItem(define map[string]interface{}) (string, map[string]interface{}) {
+	item, ok := defineValue(define, defineItemKey)
+	if !ok {
+		return "", nil
+	}
+	switch v := item.(type) {
+	case string:
+		return v, nil
+	case map[string]interface{}:
+		itemDefine, _ := v["define"].(map[string]interface{})
+		if itemDefine == nil {
+			itemDefine = v
+		}
+		return defineTypeName(v["type"]), itemDefine
+	}
+	return "", nil
+}
+
+//type name of define, numeric type is converted by DefineType
+func defineTypeName(t interface{}) string {
+	if f, ok := toNumber(t, false); ok {
+		return DefineType(int(f)).String()
+	}
+	if s, ok := t.(string); ok {
+		if i, err := strconv.Atoi(s); err == nil {
+			return DefineType(i).String()
+		}
+		return s
+	}
+	return ""
+}
+
+func checkArray(path string, define map[string]interface{}, value interface{}, coerce bool) (interface{}, *FieldError) {
+	rv := reflect.ValueOf(value)
+	if value == nil || (rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array) {
+		return nil, &FieldError{Field: path, Reason: "not an array", Value: value}
+	}
+	if size, ok := defineNumber(define, defineSizeKey); ok && size > 0 && float64(rv.Len()) > size {
+		return nil, &FieldError{Field: path, Reason: fmt.Sprintf("more than %v items", size), Value: value}
+	}
+	itemType, itemDefine := arrayItem(define)
+	if itemType == "" {
+		return value, nil
+	}
+	result := make([]interface{}, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		item, err := checkValue(fmt.Sprintf("%s[%d]", path, i), itemType, itemDefine, rv.Index(i).Interface(), coerce)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = item
+	}
+	if coerce {
+		return result, nil
+	}
+	return value, nil
+}
+
+//fields of struct define, a list of {identifier, type, define}
+func structFields(define map[string]interface{}) (map[string]map[string]interface{}, bool) {
+	fields, ok := defineValue(define, defineFieldsKey)
+	if !ok {
+		return nil, false
+	}
+	list, ok := fields.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	result := make(map[string]map[string]interface{})
+	for _, f := range list {
+		if field, ok := f.(map[string]interface{}); ok {
+			if id, ok := field["identifier"].(string); ok {
+				result[id] = field
+			}
+		}
+	}
+	return result, true
+}
+
+func checkStruct(path string, define map[string]interface{}, value interface{}, coerce bool) (interface{}, *FieldError) {
+	var object map[string]interface{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		object = v
+	case Metadata:
+		object = v
+	default:
+		return nil, &FieldError{Field: path, Reason: "not a struct", Value: value}
+	}
+	fields, ok := structFields(define)
+	if !ok {
+		return value, nil
+	}
+	result := make(map[string]interface{}, len(object))
+	for k, v := range object {
+		field, ok := fields[k]
+		if !ok {
+			return nil, &FieldError{Field: path + "." + k, Reason: "unknown field", Value: v}
+		}
+		fieldDefine, _ := field["define"].(map[string]interface{})
+		item, err := checkValue(path+"."+k, defineTypeName(field["type"]), fieldDefine, v, coerce)
+		if err != nil {
+			return nil, err
+		}
+		result[k] = item
+	}
+	if coerce {
+		return result, nil
+	}
+	return value, nil
+}
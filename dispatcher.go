@@ -0,0 +1,126 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package edge_driver_go
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+//service call dispatcher options
+type DispatcherOptions struct {
+	Workers   int           //worker count, calls of the same device run in order on one worker
+	QueueSize int           //pending calls of each worker, calls are rejected with busy reply when full
+	Timeout   time.Duration //timeout of each call, timeout reply is sent when exceeded and the worker waits for the handler to return, no timeout if 0
+}
+
+type dispatchCall func(ctx context.Context)
+
+//handlers still running after timeout, waited by worker before the next call
+type pendingKey struct{}
+
+//run service calls out of mqtt message callback
+type dispatcher struct {
+	timeout time.Duration
+	queues  []chan dispatchCall
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newDispatcher(opts DispatcherOptions) *dispatcher {
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.QueueSize < 0 {
+		opts.QueueSize = 0
+	}
+	d := &dispatcher{
+		timeout: opts.Timeout,
+		queues:  make([]chan dispatchCall, opts.Workers),
+		done:    make(chan struct{}),
+	}
+	for i := range d.queues {
+		d.queues[i] = make(chan dispatchCall, opts.QueueSize)
+		go d.run(d.queues[i])
+	}
+	return d
+}
+
+func (d *dispatcher) run(queue chan dispatchCall) {
+	for {
+		var call dispatchCall
+		select {
+		case call = <-queue:
+		case <-d.done:
+			return
+		}
+		var pending sync.WaitGroup
+		ctx, cancel := context.WithValue(context.Background(), pendingKey{}, &pending), context.CancelFunc(func() {})
+		if d.timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		}
+		call(ctx)
+		cancel()
+		//calls of a device never overlap and timed out handlers are not leaked
+		pending.Wait()
+	}
+}
+
+//queue call to worker of key, false if the worker queue is full or dispatcher is stopped
+func (d *dispatcher) dispatch(key string, call dispatchCall) bool {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	select {
+	case <-d.done:
+		return false
+	default:
+	}
+	select {
+	case d.queues[h.Sum32()%uint32(len(d.queues))] <- call:
+		return true
+	default:
+		return false
+	}
+}
+
+//stop workers, pending calls are dropped
+func (d *dispatcher) stop() {
+	d.once.Do(func() {
+		close(d.done)
+	})
+}
+
+//run handler until done or ctx done. a timed out handler keeps running in background,
+//and the dispatcher worker waits for it before the next call
+func callWithContext(ctx context.Context, f func() error) error {
+	if pending, ok := ctx.Value(pendingKey{}).(*sync.WaitGroup); ok {
+		pending.Add(1)
+		call := f
+		f = func() error {
+			defer pending.Done()
+			return call()
+		}
+	}
+	done := wait(f)
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return &ServiceError{Code: RpcTimeout, Message: ctx.Err().Error()}
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package edge_driver_go
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDispatcherOrder(t *testing.T) {
+	d := newDispatcher(DispatcherOptions{Workers: 4, QueueSize: 16})
+	result := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		i := i
+		assert.True(t, d.dispatch("iotd-test", func(ctx context.Context) {
+			result <- i
+		}))
+	}
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, i, <-result)
+	}
+}
+
+func TestDispatcherBusy(t *testing.T) {
+	d := newDispatcher(DispatcherOptions{Workers: 1, QueueSize: 1})
+	block := make(chan struct{})
+	defer close(block)
+	started := make(chan struct{})
+	assert.True(t, d.dispatch("iotd-test", func(ctx context.Context) {
+		close(started)
+		<-block
+	}))
+	<-started
+	assert.True(t, d.dispatch("iotd-test", func(ctx context.Context) {}))
+	assert.False(t, d.dispatch("iotd-test", func(ctx context.Context) {}))
+}
+
+func TestDispatcherTimeout(t *testing.T) {
+	d := newDispatcher(DispatcherOptions{Workers: 1, QueueSize: 1, Timeout: 50 * time.Millisecond})
+	result := make(chan error, 1)
+	d.dispatch("iotd-test", func(ctx context.Context) {
+		result <- callWithContext(ctx, func() error {
+			time.Sleep(time.Second)
+			return nil
+		})
+	})
+	err := <-result
+	serviceErr, ok := err.(*ServiceError)
+	assert.True(t, ok)
+	assert.Equal(t, RpcTimeout, serviceErr.Code)
+}
+
+func TestDispatcherTimeoutOrder(t *testing.T) {
+	d := newDispatcher(DispatcherOptions{Workers: 1, QueueSize: 2, Timeout: 20 * time.Millisecond})
+	defer d.stop()
+	finished := make(chan struct{})
+	replied := make(chan error, 1)
+	//handler ignores ctx
+	assert.True(t, d.dispatch("iotd-test", func(ctx context.Context) {
+		replied <- callWithContext(ctx, func() error {
+			time.Sleep(200 * time.Millisecond)
+			close(finished)
+			return nil
+		})
+	}))
+	next := make(chan bool, 1)
+	assert.True(t, d.dispatch("iotd-test", func(ctx context.Context) {
+		select {
+		case <-finished:
+			next <- true
+		default:
+			next <- false
+		}
+	}))
+	assert.NotNil(t, <-replied)
+	assert.True(t, <-next)
+}
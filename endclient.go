@@ -20,22 +20,45 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 )
 
 type endClient struct {
+	session  *Session
 	ctx      context.Context
 	cancel   context.CancelFunc
 	validate validate
 	config   config
 	//edgeServiceCall OnEdgeServiceCall //service call func
-	endServiceCall  OnEndServiceCall  //service call func
-	userServiceCall OnUserServiceCall //user service call func
-	setServiceCall  OnSetServiceCall  //set service call func
-	getServiceCall  OnGetServiceCall  //get service call func
-	logger          Logger
+	endServiceCall    OnEndServiceCallCtx  //service call func
+	userServiceCall   OnUserServiceCallCtx //user service call func
+	setServiceCall    OnSetServiceCallCtx  //set service call func
+	getServiceCall    OnGetServiceCallCtx  //get service call func
+	qos               [messageClassCount]*byte
+	retained          [messageClassCount]*bool
+	logger            Logger
+	lock              sync.Mutex
+	status            string        //status declared by Online and Offline
+	tokenStatus       TokenStatus   //token status from metadata service
+	tokenKeyFunc      TokenKeyFunc  //token verify key
+	tokenExpiryBefore time.Duration //token expiry call is called before token expires
+	tokenExpiryCall   OnTokenExpiry
+	expiryTimer       *time.Timer
+	handlers          map[string]*serviceHandler //service handlers registered by HandleService
+	restoreStatus     bool                       //republish declared status after reconnect
+	heartbeatInterval time.Duration              //heartbeat interval, disabled if 0
+	heartbeatCancel   context.CancelFunc         //stop heartbeat loop
+	probe             LivenessProbe              //liveness probe run before each heartbeat
+	probeThreshold    int                        //probe failures to report offline
+	probeFailures     int                        //probe failures in a row
+	probeDown         bool                       //reported offline by probe
+	batch             *batcher                   //batch property reporter, nil if batch report is disabled
+	changes           *changeFilter              //report on change filter, nil if disabled
+	maxMessageSize    int                        //max payload size of property history message
 }
 
-// edge sdk init
+// edge sdk init, the client is bound to the default session unless SetSession is used
 func NewEndClient(token string, opt ...ServerOption) (Client, error) {
 	var (
 		config config
@@ -43,64 +66,187 @@ func NewEndClient(token string, opt ...ServerOption) (Client, error) {
 		opts   options
 	)
 	if token == "" {
-		return nil, errors.New("token is illegal")
-	}
-	config, err = newDeviceConfig(token)
-	if err != nil {
-		return nil, err
+		return nil, &TokenError{Reason: TokenMalformed, Err: errors.New("token is illegal")}
 	}
 	opts = defaultServerOptions
 	for _, o := range opt {
 		o.apply(&opts)
 	}
+	config, err = newDeviceConfig(token, opts.tokenKeyFunc)
+	if err != nil {
+		return nil, err
+	}
+	for _, q := range opts.qos {
+		if q != nil && *q > 2 {
+			return nil, ErrInvalidQos
+		}
+	}
+	if opts.session == nil {
+		if opts.session, err = DefaultSession(); err != nil {
+			return nil, err
+		}
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	edge := &endClient{
-		validate: newDataValidate(),
+		session:  opts.session,
+		validate: newDataValidate(opts.session, opts.validateMode, opts.logger),
 		//edgeServiceCall: opts.edgeServiceCall,
-		endServiceCall:  opts.endServiceCall,
-		userServiceCall: opts.userServiceCall,
-		setServiceCall:  opts.setServiceCall,
-		getServiceCall:  opts.getServiceCall,
-		logger:          opts.logger,
-		config:          config,
-		ctx:             ctx,
-		cancel:          cancel,
+		endServiceCall:    opts.endServiceCall,
+		userServiceCall:   opts.userServiceCall,
+		setServiceCall:    opts.setServiceCall,
+		getServiceCall:    opts.getServiceCall,
+		qos:               opts.qos,
+		retained:          opts.retained,
+		logger:            opts.logger,
+		config:            config,
+		ctx:               ctx,
+		cancel:            cancel,
+		tokenStatus:       Enable,
+		handlers:          make(map[string]*serviceHandler),
+		restoreStatus:     opts.restoreStatus,
+		heartbeatInterval: opts.heartbeatInterval,
+		probe:             opts.probe,
+		probeThreshold:    opts.probeThreshold,
+		maxMessageSize:    opts.maxMessageSize,
+		tokenKeyFunc:      opts.tokenKeyFunc,
+		tokenExpiryBefore: opts.tokenExpiryBefore,
+		tokenExpiryCall:   opts.tokenExpiryCall,
 	}
+	if opts.changes != nil {
+		edge.changes = newChangeFilter(opts.changes.defaults, opts.changes.filters)
+	}
+	if opts.batch != nil {
+		edge.batch = newBatcher(*opts.batch, edge.reportBatch, opts.logger)
+	}
+	edge.watchTokenExpiry()
 	return edge, nil
 }
+
+// create end client bound to session
+func (s *Session) NewEndClient(token string, opt ...ServerOption) (Client, error) {
+	return NewEndClient(token, append(opt, SetSession(s))...)
+}
+
+//get publish policy of message class, client settings override session settings
+func (e *endClient) policy(class MessageClass) publishPolicy {
+	policy := e.session.policy(class)
+	if e.qos[class] != nil {
+		policy.qos = *e.qos[class]
+	}
+	if e.retained[class] != nil {
+		policy.retained = *e.retained[class]
+	}
+	return policy
+}
+
+//close client, pending batch samples are reported, then its topics are unsubscribed and it is removed from session
+func (e *endClient) Close(ctx context.Context) error {
+	if err := e.Flush(ctx); err != nil && e.logger != nil {
+		e.logger.Warn("[sdk] flush batch report failed:", e.config.DeviceId(), err.Error())
+	}
+	e.cancel()
+	e.lock.Lock()
+	if e.expiryTimer != nil {
+		e.expiryTimer.Stop()
+		e.expiryTimer = nil
+	}
+	e.lock.Unlock()
+	done := wait(func() error {
+		var err error
+		//retained online status would outlive the client
+		if e.getStatus() == online {
+			e.setStatus(offline)
+			if err = e.publishStatus(offline); errors.Is(err, ErrNotConnected) {
+				err = nil
+			}
+		}
+		if unregisterErr := e.session.unregisterEndClient(e); unregisterErr != nil && err == nil {
+			err = unregisterErr
+		}
+		if unsubscribeErr := e.session.unsubscribe(e.topics()...); unsubscribeErr != nil && !errors.Is(unsubscribeErr, ErrNotConnected) {
+			return unsubscribeErr
+		}
+		return err
+	})
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ErrTimeout
+	}
+}
+
+//topics subscribed by init
+func (e *endClient) topics() []string {
+	var msg message
+	if isUserDevice(e.config.ThingId()) {
+		return []string{msg.buildUserServiceTopic(e.config.DeviceId(), e.config.ThingId())}
+	}
+	return []string{
+		msg.buildSetTopic(e.config.DeviceId(), e.config.ThingId()),
+		msg.buildGetTopic(e.config.DeviceId(), e.config.ThingId()),
+		fmt.Sprintf(deviceService, e.config.ThingId(), e.config.DeviceId(), "+"),
+	}
+}
+//subscribe service topics of end client, called on online and again after hub reconnect
 func (e *endClient) init() error {
 	var (
 		err error
 		msg message
 	)
 	if isUserDevice(e.config.ThingId()) {
-		err = getSessionIns().subscribe(msg.buildUserServiceTopic(e.config.DeviceId(), e.config.ThingId()), e.userCall)
+		err = e.session.subscribe(msg.buildUserServiceTopic(e.config.DeviceId(), e.config.ThingId()), e.policy(SubscribeMessage).qos, e.dispatch(e.userCall))
 		if err != nil {
 			return err
 		}
 	} else {
 		//end service
-		err = getSessionIns().subscribe(msg.buildSetTopic(e.config.DeviceId(), e.config.ThingId()), e.endCall)
+		err = e.session.subscribe(msg.buildSetTopic(e.config.DeviceId(), e.config.ThingId()), e.policy(SubscribeMessage).qos, e.dispatch(e.setCall))
 		if err != nil {
 			return err
 		}
-		err = getSessionIns().subscribe(msg.buildGetTopic(e.config.DeviceId(), e.config.ThingId()), e.getCall)
+		err = e.session.subscribe(msg.buildGetTopic(e.config.DeviceId(), e.config.ThingId()), e.policy(SubscribeMessage).qos, e.dispatch(e.getCall))
 		if err != nil {
 			return err
 		}
-		err = getSessionIns().subscribe(fmt.Sprintf(deviceService, e.config.ThingId(), e.config.DeviceId(), "+"), e.endCall)
+		err = e.session.subscribe(fmt.Sprintf(deviceService, e.config.ThingId(), e.config.DeviceId(), "+"), e.policy(SubscribeMessage).qos, e.dispatch(e.endCall))
 		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
-func (e *endClient) setCall(topic string, payload []byte) {
+
+//wrap service call handler to run on session dispatcher, busy reply is sent when dispatcher is full
+func (e *endClient) dispatch(call func(ctx context.Context, topic string, payload []byte)) messageArrived {
+	return func(topic string, payload []byte) {
+		if e.session.dispatch(e.config.DeviceId(), func(ctx context.Context) {
+			call(ctx, topic, payload)
+		}) {
+			return
+		}
+		if e.logger != nil {
+			e.logger.Warn("[sdk] service call rejected, device busy:", topic)
+		}
+		if isUserDevice(e.config.ThingId()) {
+			return
+		}
+		var msg message
+		if req, err := msg.parseResponseMsg(payload); err == nil {
+			e.serviceReply(topic, &serviceReply{
+				Id:      req.Id,
+				Code:    RpcDeviceBusy,
+				Data:    make(Metadata),
+				Message: "device busy",
+			})
+		}
+	}
+}
+func (e *endClient) setCall(ctx context.Context, topic string, payload []byte) {
 	var (
 		msg  message
 		req  *serviceRequest
 		resp *serviceReply
-		buf  []byte
 		err  error
 	)
 	req, err = msg.parseResponseMsg(payload)
@@ -112,32 +258,40 @@ func (e *endClient) setCall(topic string, payload []byte) {
 		Code: RpcSuccess,
 		Data: make(Metadata),
 	}
-	if e.setServiceCall != nil {
-		if err = e.setServiceCall(req.Params); err != nil {
-			resp.Code = RpcFail
-		}
-	}
-	buf, err = json.Marshal(resp)
-	if err != nil {
-		return
-	}
-	if err = getSessionIns().publish(topic+"_reply", buf); err != nil {
-		if e.logger != nil {
-			e.logger.Error(fmt.Sprintf("requestServiceReply err:%s", err.Error()))
+	switch {
+	case e.setServiceCall != nil:
+		if err = callWithContext(ctx, func() error {
+			return e.setServiceCall(ctx, e.serviceRequest(topic, req.Id, payload), req.Params)
+		}); err != nil {
+			resp.setError(err)
 		}
-	} else {
-		if e.logger != nil {
-			e.logger.Error(fmt.Sprintf("requestServiceReply  topic:%s,data:%s", topic+"_reply", string(buf)))
+	case e.endServiceCall != nil:
+		//property set is an end service call of method base if set handler is not set
+		var reply *Reply
+		if err = callWithContext(ctx, func() (err error) {
+			reply, err = e.endServiceCall(ctx, e.serviceRequest(topic, req.Id, payload), req.Params)
+			return
+		}); err != nil {
+			resp.setError(err)
+		} else if reply == nil {
+			resp.Code = RpcFail
+		} else {
+			resp.Code = reply.Code
+			resp.Data = reply.Data
+			resp.Message = reply.Message
 		}
+	default:
+		resp.Code = RpcUnsupported
+		resp.Message = "property set not supported"
 	}
+	e.serviceReply(topic, resp)
 }
-func (e *endClient) getCall(topic string, payload []byte) {
+func (e *endClient) getCall(ctx context.Context, topic string, payload []byte) {
 	var (
 		msg  message
 		req  *serviceGetRequest
 		resp *serviceReply
 		data Metadata
-		buf  []byte
 		err  error
 	)
 	req, err = msg.parseGetServiceMsg(payload)
@@ -149,37 +303,29 @@ func (e *endClient) getCall(topic string, payload []byte) {
 		Code: RpcSuccess,
 		Data: make(Metadata),
 	}
-	if e.setServiceCall != nil {
-		if data, err = e.getServiceCall(req.Params); err != nil {
-			resp.Code = RpcFail
+	if e.getServiceCall != nil {
+		if err = callWithContext(ctx, func() (err error) {
+			data, err = e.getServiceCall(ctx, e.serviceRequest(topic, req.Id, payload), req.Params)
+			return
+		}); err != nil {
+			resp.setError(err)
 		} else {
 			resp.Data = data
 		}
 	}
-	buf, err = json.Marshal(resp)
-	if err != nil {
-		return
-	}
-	if err = getSessionIns().publish(topic+"_reply", buf); err != nil {
-		if e.logger != nil {
-			e.logger.Error(fmt.Sprintf("requestServiceReply err:%s", err.Error()))
-		}
-	} else {
-		if e.logger != nil {
-			e.logger.Error(fmt.Sprintf("requestServiceReply  topic:%s,data:%s", topic+"_reply", string(buf)))
-		}
-	}
+	e.serviceReply(topic, resp)
 }
-func (e *endClient) endCall(topic string, payload []byte) {
+func (e *endClient) endCall(ctx context.Context, topic string, payload []byte) {
 	var (
 		msg        message
 		req        *serviceRequest
 		methodName string
-		deviceId   string
+		deviceId   = e.config.DeviceId()
+		call       OnEndServiceCallCtx
+		validate   bool
 		data       Metadata
 		reply      *Reply
 		resp       *serviceReply
-		buf        []byte
 		err        error
 	)
 	defer func() {
@@ -189,7 +335,7 @@ func (e *endClient) endCall(topic string, payload []byte) {
 			}
 		}
 	}()
-	deviceId, methodName, err = msg.parseServiceMethod(topic)
+	_, methodName, err = msg.parseServiceMethod(topic)
 	if err != nil {
 		return
 	}
@@ -197,47 +343,91 @@ func (e *endClient) endCall(topic string, payload []byte) {
 	if err != nil {
 		return
 	}
-	if err = e.validate.validateServiceInput(context.Background(), deviceId, methodName, req.Params); err != nil {
-		return
-	}
-	if e.logger != nil {
-		e.logger.Warn(topic, payload)
-	}
 	resp = &serviceReply{
 		Id:   req.Id,
 		Code: RpcSuccess,
 		Data: make(Metadata),
 	}
-	if e.endServiceCall != nil {
-		if reply, err = e.endServiceCall(methodName, req.Params); err != nil || reply == nil {
-			resp.Code = RpcFail
-		} else {
-			resp.Code = reply.Code
-			resp.Data = reply.Data
+	if handler := e.serviceHandler(methodName); handler != nil {
+		call, validate = handler.call, handler.validate
+	} else if e.endServiceCall != nil {
+		call, validate = e.endServiceCall, true
+	} else {
+		resp.Code = RpcUnsupported
+		resp.Message = "method not found: " + methodName
+		e.serviceReply(topic, resp)
+		return
+	}
+	if validate {
+		if req.Params, err = e.validate.validateServiceInput(ctx, deviceId, methodName, req.Params); err != nil {
+			resp.setError(err)
+			e.serviceReply(topic, resp)
+			return
 		}
-		if err = e.validate.validateServiceOutput(context.Background(), deviceId, methodName, data); err != nil {
-			resp.Code = RpcFail
+	}
+	if e.logger != nil {
+		e.logger.Warn(topic, payload)
+	}
+	if err = callWithContext(ctx, func() (err error) {
+		reply, err = call(ctx, e.serviceRequest(topic, req.Id, payload), req.Params)
+		return
+	}); err != nil {
+		resp.setError(err)
+	} else if reply == nil {
+		resp.Code = RpcFail
+	} else {
+		resp.Code = reply.Code
+		resp.Data = reply.Data
+		resp.Message = reply.Message
+	}
+	if resp.Code == RpcSuccess && validate {
+		if data, err = toMetadata(resp.Data); err == nil {
+			data, err = e.validate.validateServiceOutput(ctx, deviceId, methodName, data)
 		}
-		buf, err = json.Marshal(resp)
 		if err != nil {
-			return
-		}
-		if err = getSessionIns().publish(topic+"_reply", buf); err != nil {
-			if e.logger != nil {
-				e.logger.Error(fmt.Sprintf("[sdk] requestServiceReply err:%s", err.Error()))
-			}
+			resp.Data = make(Metadata)
+			resp.setError(err)
+			resp.Code = RpcInternalError
 		} else {
-			if e.logger != nil {
-				e.logger.Info(fmt.Sprintf("[sdk] requestServiceReply  topic:%s,data:%s", topic+"_reply", string(buf)))
-			}
+			resp.Data = data
+		}
+	}
+	e.serviceReply(topic, resp)
+}
+
+//build service request info of handler
+func (e *endClient) serviceRequest(topic string, id string, payload []byte) *ServiceRequest {
+	var msg message
+	_, method, _ := msg.parseServiceMethod(topic)
+	return &ServiceRequest{
+		Id:       id,
+		DeviceId: e.config.DeviceId(),
+		ThingId:  e.config.ThingId(),
+		Method:   method,
+		Payload:  payload,
+	}
+}
+
+//publish service reply
+func (e *endClient) serviceReply(topic string, resp *serviceReply) {
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		if e.logger != nil {
+			e.logger.Error(fmt.Sprintf("[sdk] requestServiceReply err:%s", err.Error()))
+		}
+		return
+	}
+	if err = e.session.publish(topic+"_reply", buf, e.policy(ServiceReplyMessage)); err != nil {
+		if e.logger != nil {
+			e.logger.Error(fmt.Sprintf("[sdk] requestServiceReply err:%s", err.Error()))
 		}
 	} else {
-		//if e.logger != nil {
-		//	e.logger.Warn("callback not set")
-		//}
+		if e.logger != nil {
+			e.logger.Info(fmt.Sprintf("[sdk] requestServiceReply  topic:%s,data:%s", topic+"_reply", string(buf)))
+		}
 	}
 }
-func (e *endClient) userCall(topic string, payload []byte) {
+func (e *endClient) userCall(ctx context.Context, topic string, payload []byte) {
 	var (
 		data []byte
 		err  error
@@ -253,10 +443,13 @@ func (e *endClient) userCall(topic string, payload []byte) {
 		e.logger.Info(topic, payload)
 	}
 	if e.userServiceCall != nil {
-		if data, err = e.userServiceCall(payload); err != nil {
+		if err = callWithContext(ctx, func() (err error) {
+			data, err = e.userServiceCall(ctx, e.serviceRequest(topic, "", payload), payload)
+			return
+		}); err != nil {
 			return
 		} else {
-			if err = getSessionIns().publish(topic+"_reply", data); err != nil {
+			if err = e.session.publish(topic+"_reply", data, e.policy(ServiceReplyMessage)); err != nil {
 				if e.logger != nil {
 					e.logger.Error(fmt.Sprintf("[sdk] userCall err:%s", err.Error()))
 				}
@@ -273,137 +466,201 @@ func (e *endClient) userCall(topic string, payload []byte) {
 	}
 }
 func (e *endClient) ReportUserMessage(ctx context.Context, payload []byte) error {
+	ctx, receipt := newDelivery(ctx)
 	done := wait(func() error {
 		var (
 			topic string
 			msg   message
 		)
 		topic = msg.buildUserTopic(e.config.DeviceId(), e.config.ThingId())
-		return getSessionIns().publish(topic, payload)
+		return e.session.publishCtx(ctx, topic, payload, e.policy(OtherMessage))
 	})
 	select {
 	case err := <-done:
+		receipt.fill()
 		return err
 	case <-ctx.Done():
-		return rpcTimeout
+		receipt.fill()
+		return ErrPublishTimeout
 	}
 }
 func (e *endClient) Online(ctx context.Context) error {
 	done := wait(func() error {
-		var (
-			topic string
-			msg   message
-			data  []byte
-			err   error
-		)
-		topic = msg.buildStatusTopic(e.config.DeviceId(), e.config.ThingId())
-		data = msg.buildHeartbeatMsg(e.config.DeviceId(), e.config.ThingId(), online)
-		err = getSessionIns().publish(topic, data)
-		if err != nil {
+		var err error
+		if e.tokenDisabled() {
+			return ErrTokenDisabled
+		}
+		if err = e.publishStatus(online); err != nil {
 			return err
 		}
-		err = getSessionIns().registerEndClient(e)
+		e.setStatus(online)
+		err = e.session.registerEndClient(e)
 		if err != nil {
 			return err
 		}
-		return e.init()
+		if err = e.init(); err != nil {
+			return err
+		}
+		e.startHeartbeat()
+		return nil
 	})
 	select {
 	case err := <-done:
 		return err
 	case <-ctx.Done():
-		return rpcTimeout
+		return ErrTimeout
 	}
 }
 func (e *endClient) Offline(ctx context.Context) error {
 	done := wait(func() error {
-		var (
-			topic string
-			msg   message
-			data  []byte
-		)
-		topic = msg.buildStatusTopic(e.config.DeviceId(), e.config.ThingId())
-		data = msg.buildHeartbeatMsg(e.config.DeviceId(), e.config.ThingId(), offline)
-		return getSessionIns().publish(topic, data)
+		if err := e.publishStatus(offline); err != nil {
+			return err
+		}
+		e.setStatus(offline)
+		e.stopHeartbeat()
+		return nil
 	})
 	select {
 	case err := <-done:
 		return err
 	case <-ctx.Done():
-		return rpcTimeout
+		return ErrTimeout
 	}
 }
 
+//publish device status
+func (e *endClient) publishStatus(status string) error {
+	var (
+		topic string
+		msg   message
+		data  []byte
+	)
+	topic = msg.buildStatusTopic(e.config.DeviceId(), e.config.ThingId())
+	data = msg.buildHeartbeatMsg(e.config.DeviceId(), e.config.ThingId(), status)
+	return e.session.publish(topic, data, e.policy(StatusMessage))
+}
+
+//republish declared status after hub reconnect, the client is offline while token is disabled or probe fails
+func (e *endClient) restoreDeclaredStatus() {
+	status := e.liveStatus()
+	if !e.restoreStatus || status == "" {
+		return
+	}
+	if err := e.publishStatus(status); err != nil && e.logger != nil {
+		e.logger.Warn("[sdk] restore device status failed:", e.config.DeviceId(), err.Error())
+	}
+}
+
+func (e *endClient) setStatus(status string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.status = status
+}
+
 //report device property to cloud with tags and time
 func (e *endClient) ReportPropertiesWithTagsEx(ctx context.Context, params MetadataMsg, tags Metadata) error {
+	ctx, receipt := newDelivery(ctx)
 	done := wait(func() error {
 		var (
 			topic string
 			msg   message
 			data  []byte
+			ok    bool
 			err   error
 		)
 		if params, err = e.validate.validatePropertiesEx(ctx, e.config.DeviceId(), params); err != nil {
 			return err
 		}
+		if params, ok = e.changedPropertiesEx(params); !ok {
+			return nil
+		}
 		topic = msg.buildPropertyTopic(e.config.DeviceId(), e.config.ThingId())
 		data = msg.buildPropertyMsgWithTagsEx(e.config.DeviceId(), e.config.ThingId(), params, tags)
-		return getSessionIns().publish(topic, data)
+		if err = e.session.report(ctx, topic, data, e.policy(PropertyMessage)); err != nil {
+			return err
+		}
+		e.commitProperties(msgValues(params))
+		return nil
 	})
 	select {
 	case err := <-done:
+		receipt.fill()
 		return err
 	case <-ctx.Done():
-		return rpcTimeout
+		receipt.fill()
+		return ErrPublishTimeout
 	}
 }
 func (e *endClient) ReportPropertiesWithTags(ctx context.Context, params Metadata, tags Metadata) error {
+	ctx, receipt := newDelivery(ctx)
 	done := wait(func() error {
 		var (
 			topic string
 			msg   message
 			data  []byte
 			//thingId string
+			ok  bool
 			err error
 		)
 		if params, err = e.validate.validateProperties(ctx, e.config.DeviceId(), params); err != nil {
 			return err
 		}
+		if params, ok = e.changedProperties(params); !ok {
+			return nil
+		}
 		topic = msg.buildPropertyTopic(e.config.DeviceId(), e.config.ThingId())
 		data = msg.buildPropertyMsgWithTags(e.config.DeviceId(), e.config.ThingId(), params, tags)
-		return getSessionIns().publish(topic, data)
+		if err = e.session.report(ctx, topic, data, e.policy(PropertyMessage)); err != nil {
+			return err
+		}
+		e.commitProperties(params)
+		return nil
 	})
 	select {
 	case err := <-done:
+		receipt.fill()
 		return err
 	case <-ctx.Done():
-		return rpcTimeout
+		receipt.fill()
+		return ErrPublishTimeout
 	}
 }
 func (e *endClient) ReportProperties(ctx context.Context, params Metadata) error {
+	ctx, receipt := newDelivery(ctx)
 	done := wait(func() error {
 		var (
 			topic string
 			msg   message
 			data  []byte
 			//thingId string
+			ok  bool
 			err error
 		)
 		if params, err = e.validate.validateProperties(ctx, e.config.DeviceId(), params); err != nil {
 			return err
 		}
+		if params, ok = e.changedProperties(params); !ok {
+			return nil
+		}
 		topic = msg.buildPropertyTopic(e.config.DeviceId(), e.config.ThingId())
 		data = msg.buildPropertyMsg(e.config.DeviceId(), e.config.ThingId(), params)
-		return getSessionIns().publish(topic, data)
+		if err = e.session.report(ctx, topic, data, e.policy(PropertyMessage)); err != nil {
+			return err
+		}
+		e.commitProperties(params)
+		return nil
 	})
 	select {
 	case err := <-done:
+		receipt.fill()
 		return err
 	case <-ctx.Done():
-		return rpcTimeout
+		receipt.fill()
+		return ErrPublishTimeout
 	}
 }
 func (e *endClient) ReportEvent(ctx context.Context, eventId string, params Metadata) error {
+	ctx, receipt := newDelivery(ctx)
 	done := wait(func() error {
 		var (
 			topic string
@@ -412,21 +669,24 @@ func (e *endClient) ReportEvent(ctx context.Context, eventId string, params Meta
 			//thingId string
 			err error
 		)
-		if err = e.validate.validateEvent(ctx, e.config.DeviceId(), eventId, params); err != nil {
+		if params, err = e.validate.validateEvent(ctx, e.config.DeviceId(), eventId, params); err != nil {
 			return err
 		}
 		topic = msg.buildEventTopic(e.config.DeviceId(), e.config.ThingId(), eventId)
 		data = msg.buildEventMsg(e.config.DeviceId(), e.config.ThingId(), eventId, params)
-		return getSessionIns().publish(topic, data)
+		return e.session.report(ctx, topic, data, e.policy(EventMessage))
 	})
 	select {
 	case err := <-done:
+		receipt.fill()
 		return err
 	case <-ctx.Done():
-		return rpcTimeout
+		receipt.fill()
+		return ErrPublishTimeout
 	}
 }
 func (e *endClient) ReportDeviceInfo(ctx context.Context, params *DeviceMsg) error {
+	ctx, receipt := newDelivery(ctx)
 	done := wait(func() error {
 		var (
 			topic string
@@ -435,12 +695,14 @@ func (e *endClient) ReportDeviceInfo(ctx context.Context, params *DeviceMsg) err
 		)
 		topic = msg.buildDeviceInfoTopic(e.config.DeviceId(), e.config.ThingId())
 		data = msg.buildDeviceInfoMsg(e.config.DeviceId(), e.config.ThingId(), params)
-		return getSessionIns().publish(topic, data)
+		return e.session.publishCtx(ctx, topic, data, e.policy(OtherMessage))
 	})
 	select {
 	case err := <-done:
+		receipt.fill()
 		return err
 	case <-ctx.Done():
-		return rpcTimeout
+		receipt.fill()
+		return ErrPublishTimeout
 	}
 }
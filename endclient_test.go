@@ -0,0 +1,422 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package edge_driver_go
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestSession(t *testing.T, opt ...SessionOption) *Session {
+	opt = append([]SessionOption{SetDriverId("driver"), SetEdgeDevice("iotd-edge", "iott-edge"),
+		SetHubAddress("tcp://127.0.0.1:1")}, opt...)
+	s, err := NewSession(opt...)
+	assert.Nil(t, err)
+	return s
+}
+
+//fake hub client records published messages
+type fakeClient struct {
+	lock       sync.Mutex
+	published  []*fakeMessage
+	publishErr error //error of publish token
+	pending    bool  //publish token never completes
+	handlers   map[string]mqtt.MessageHandler
+}
+type fakeMessage struct {
+	topic    string
+	retained bool
+	payload  []byte
+}
+
+func (m *fakeMessage) Duplicate() bool   { return false }
+func (m *fakeMessage) Qos() byte         { return 0 }
+func (m *fakeMessage) Retained() bool    { return m.retained }
+func (m *fakeMessage) Topic() string     { return m.topic }
+func (m *fakeMessage) MessageID() uint16 { return 0 }
+func (m *fakeMessage) Payload() []byte   { return m.payload }
+func (m *fakeMessage) Ack()              {}
+
+type fakeToken struct {
+	err     error
+	pending bool
+}
+
+func (t fakeToken) Wait() bool                     { return !t.pending }
+func (t fakeToken) WaitTimeout(time.Duration) bool { return !t.pending }
+func (t fakeToken) Error() error                   { return t.err }
+
+func (c *fakeClient) IsConnected() bool      { return true }
+func (c *fakeClient) IsConnectionOpen() bool { return true }
+func (c *fakeClient) Connect() mqtt.Token    { return fakeToken{} }
+func (c *fakeClient) Disconnect(uint)        {}
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.published = append(c.published, &fakeMessage{topic: topic, retained: retained, payload: payload.([]byte)})
+	return fakeToken{err: c.publishErr, pending: c.pending}
+}
+func (c *fakeClient) Subscribe(topic string, qos byte, handler mqtt.MessageHandler) mqtt.Token {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.handlers == nil {
+		c.handlers = make(map[string]mqtt.MessageHandler)
+	}
+	c.handlers[topic] = handler
+	return fakeToken{}
+}
+func (c *fakeClient) SubscribeMultiple(map[string]byte, mqtt.MessageHandler) mqtt.Token {
+	return fakeToken{}
+}
+func (c *fakeClient) Unsubscribe(...string) mqtt.Token        { return fakeToken{} }
+func (c *fakeClient) AddRoute(string, mqtt.MessageHandler)    {}
+func (c *fakeClient) OptionsReader() mqtt.ClientOptionsReader { return mqtt.ClientOptionsReader{} }
+func (c *fakeClient) messages() []*fakeMessage {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]*fakeMessage(nil), c.published...)
+}
+
+//deliver message to handler subscribed on topic, false if topic is not subscribed
+func (c *fakeClient) deliver(topic string, payload []byte) bool {
+	c.lock.Lock()
+	handler := c.handlers[topic]
+	c.lock.Unlock()
+	if handler == nil {
+		return false
+	}
+	handler(c, &fakeMessage{topic: topic, payload: payload})
+	return true
+}
+
+//wait for message published on topic
+func (c *fakeClient) waitMessage(topic string, timeout time.Duration) *fakeMessage {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, m := range c.messages() {
+			if m.topic == topic {
+				return m
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+//replace session hub client with fake client in connected state
+func connectFake(s *Session) *fakeClient {
+	client := &fakeClient{}
+	s.client = client
+	atomic.StoreUint32(&s.status, hubConnected)
+	return client
+}
+
+//options of the session created by newTestClient, applied after the test defaults
+type testSessionOption []SessionOption
+
+func (testSessionOption) apply(*options) {}
+
+//create end client of test token on a session connected to fake hub client, thing model is
+//served by test model server and driver will is disabled, call done when the test finishes
+func newTestClient(t *testing.T, opts ...ServerOption) (client ClientEx, fake *fakeClient, ctx context.Context, done func()) {
+	server := newTestModelServer()
+	sessionOpts := []SessionOption{SetMetadataAddress(server.URL), SetDriverWill(false)}
+	for _, opt := range opts {
+		if o, ok := opt.(testSessionOption); ok {
+			sessionOpts = append(sessionOpts, o...)
+		}
+	}
+	session := newTestSession(t, sessionOpts...)
+	c, err := NewEndClient(newTestToken(t, testTokenKey, time.Time{}), append(opts, SetSession(session))...)
+	assert.Nil(t, err)
+	client = c.(ClientEx)
+	fake = connectFake(session)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	return client, fake, ctx, func() {
+		cancel()
+		server.Close()
+	}
+}
+
+func TestTokenExpiryCall(t *testing.T) {
+	expired := make(chan string, 1)
+	client, err := NewEndClient(newTestToken(t, testTokenKey, time.Now().Add(2*time.Second)),
+		SetSession(newTestSession(t)),
+		SetTokenExpiryCall(1900*time.Millisecond, func(deviceId string, expiresAt time.Time) {
+			expired <- deviceId
+		}))
+	assert.Nil(t, err)
+	assert.NotNil(t, client)
+	select {
+	case deviceId := <-expired:
+		assert.Equal(t, "iotd-test", deviceId)
+	case <-time.After(time.Second):
+		t.Fatal("token expiry call not called")
+	}
+}
+func TestRefreshToken(t *testing.T) {
+	token := newTestToken(t, testTokenKey, time.Now().Add(time.Hour))
+	status := string(Disable)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&device{
+			DeviceId:     "iotd-test",
+			TokenContent: token,
+			TokenStatus:  status,
+		})
+	}))
+	defer server.Close()
+	client, err := NewEndClient(newTestToken(t, testTokenKey, time.Now().Add(time.Minute)),
+		SetSession(newTestSession(t, SetMetadataAddress(server.URL))))
+	assert.Nil(t, err)
+	e := client.(*endClient)
+	e.refreshToken()
+	assert.Equal(t, token, e.config.Token())
+	assert.True(t, e.tokenDisabled())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	assert.Equal(t, ErrTokenDisabled, client.Online(ctx))
+
+	//missing token status does not reset the status
+	status = ""
+	e.refreshToken()
+	assert.True(t, e.tokenDisabled())
+}
+
+func TestServiceCallAdapter(t *testing.T) {
+	var name string
+	client, err := NewEndClient(newTestToken(t, testTokenKey, time.Time{}),
+		SetSession(newTestSession(t)),
+		SetEndServiceCall(func(method string, args Metadata) (*Reply, error) {
+			name = method
+			return &Reply{Code: RpcSuccess, Data: args}, nil
+		}),
+		SetGetServiceCallCtx(func(ctx context.Context, req *ServiceRequest, args []string) (Metadata, error) {
+			return Metadata{"deviceId": req.DeviceId, "method": req.Method}, nil
+		}))
+	assert.Nil(t, err)
+	e := client.(*endClient)
+	topic := fmt.Sprintf(deviceService, "iott-test", "iotd-test", "reboot")
+	req := e.serviceRequest(topic, "1", []byte("{}"))
+	assert.Equal(t, "iotd-test", req.DeviceId)
+	assert.Equal(t, "iott-test", req.ThingId)
+	assert.Equal(t, "reboot", req.Method)
+	reply, err := e.endServiceCall(context.Background(), req, Metadata{"delay": 1})
+	assert.Nil(t, err)
+	assert.Equal(t, "reboot", name)
+	assert.Equal(t, Metadata{"delay": 1}, reply.Data)
+	data, err := e.getServiceCall(context.Background(), req, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, Metadata{"deviceId": "iotd-test", "method": "reboot"}, data)
+	assert.Nil(t, e.setServiceCall)
+}
+
+func TestSetServiceCall(t *testing.T) {
+	called := make(chan Metadata, 1)
+	client, fake, ctx, done := newTestClient(t, SetSetServiceCallCtx(func(ctx context.Context, req *ServiceRequest, args Metadata) error {
+		called <- args
+		return nil
+	}))
+	defer done()
+	assert.Nil(t, client.Online(ctx))
+
+	var msg message
+	topic := msg.buildSetTopic("iotd-test", "iott-test")
+	assert.True(t, fake.deliver(topic, []byte(`{"id":"1","version":"v1.0.0","params":{"temp":1}}`)))
+	select {
+	case args := <-called:
+		assert.Equal(t, Metadata{"temp": float64(1)}, args)
+	case <-time.After(time.Second):
+		t.Fatal("set service call not called")
+	}
+	reply := fake.waitMessage(topic+"_reply", time.Second)
+	assert.NotNil(t, reply)
+	if reply != nil {
+		assert.JSONEq(t, `{"id":"1","code":200,"data":{}}`, string(reply.payload))
+	}
+}
+
+func TestSetServiceError(t *testing.T) {
+	client, fake, ctx, done := newTestClient(t, SetSetServiceCallCtx(func(ctx context.Context, req *ServiceRequest, args Metadata) error {
+		if _, ok := args["temp"]; ok {
+			return &ServiceError{Code: RpcInvalidParams, Message: "temp is read only", Details: Metadata{"field": "temp"}}
+		}
+		return errors.New("set failed")
+	}))
+	defer done()
+	assert.Nil(t, client.Online(ctx))
+
+	var msg message
+	topic := msg.buildSetTopic("iotd-test", "iott-test")
+	assert.True(t, fake.deliver(topic, []byte(`{"id":"1","version":"v1.0.0","params":{"temp":1}}`)))
+	reply := fake.waitMessage(topic+"_reply", time.Second)
+	assert.NotNil(t, reply)
+	if reply != nil {
+		assert.JSONEq(t, fmt.Sprintf(`{"id":"1","code":%d,"data":{},"message":"temp is read only","details":{"field":"temp"}}`, RpcInvalidParams),
+			string(reply.payload))
+	}
+
+	published := len(fake.messages())
+	assert.True(t, fake.deliver(topic, []byte(`{"id":"2","version":"v1.0.0","params":{"mode":1}}`)))
+	time.Sleep(100 * time.Millisecond)
+	messages := fake.messages()[published:]
+	assert.Len(t, messages, 1)
+	assert.JSONEq(t, fmt.Sprintf(`{"id":"2","code":%d,"data":{},"message":"set failed"}`, RpcFail), string(messages[0].payload))
+}
+
+func TestSetServiceFallback(t *testing.T) {
+	var method string
+	client, fake, ctx, done := newTestClient(t, SetEndServiceCall(func(name string, args Metadata) (*Reply, error) {
+		method = name
+		return &Reply{Code: RpcSuccess, Data: Metadata{}}, nil
+	}))
+	defer done()
+	unsupported, err := NewEndClient(newTestToken(t, testTokenKey, time.Time{}), SetSession(client.(*endClient).session))
+	assert.Nil(t, err)
+	var msg message
+	topic := msg.buildSetTopic("iotd-test", "iott-test")
+
+	//property set goes to end service call without set handler
+	e := client.(*endClient)
+	e.setCall(ctx, topic, []byte(`{"id":"1","params":{"temp":1}}`))
+	assert.Equal(t, "base", method)
+	reply := fake.waitMessage(topic+"_reply", time.Second)
+	assert.NotNil(t, reply)
+	if reply != nil {
+		assert.JSONEq(t, `{"id":"1","code":200,"data":{}}`, string(reply.payload))
+	}
+
+	//property set is not acknowledged without any handler
+	published := len(fake.messages())
+	unsupported.(*endClient).setCall(ctx, topic, []byte(`{"id":"2","params":{"temp":1}}`))
+	messages := fake.messages()[published:]
+	assert.Len(t, messages, 1)
+	assert.JSONEq(t, fmt.Sprintf(`{"id":"2","code":%d,"data":{},"message":"property set not supported"}`, RpcUnsupported),
+		string(messages[0].payload))
+}
+
+func TestEndClientClose(t *testing.T) {
+	client, _, ctx, done := newTestClient(t)
+	defer done()
+	e := client.(*endClient)
+	session := e.session
+	assert.Nil(t, session.registerEndClient(e))
+	assert.Equal(t, 1, len(session.endClients()))
+	assert.Nil(t, client.Close(ctx))
+	assert.Equal(t, 0, len(session.endClients()))
+	assert.NotNil(t, e.ctx.Err())
+}
+
+func TestSessionClose(t *testing.T) {
+	session := newTestSession(t, SetDriverWill(false), SetDispatcher(DispatcherOptions{Workers: 1}))
+	client, err := NewEndClient(newTestToken(t, testTokenKey, time.Time{}), SetSession(session))
+	assert.Nil(t, err)
+	assert.Nil(t, session.registerEndClient(client.(*endClient)))
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	assert.Nil(t, session.Close(ctx))
+	assert.Equal(t, 0, len(session.endClients()))
+	assert.False(t, session.dispatch("iotd-test", func(ctx context.Context) {}))
+	err = session.Connect(ctx)
+	connectErr, ok := err.(*ConnectError)
+	assert.True(t, ok)
+	assert.Equal(t, ErrSessionClosed, connectErr.Err)
+}
+
+func TestSessionCloseRetained(t *testing.T) {
+	client, fake, ctx, done := newTestClient(t, testSessionOption{SetDriverWill(true)})
+	defer done()
+	assert.Nil(t, client.Online(ctx))
+	assert.Nil(t, client.(*endClient).session.Close(ctx))
+
+	//last retained message of each topic is what the broker keeps
+	retained := make(map[string][]byte)
+	for _, m := range fake.messages() {
+		if m.retained {
+			retained[m.topic] = m.payload
+		}
+	}
+	var msg message
+	assert.Contains(t, string(retained[msg.buildStatusTopic("iotd-test", "iott-test")]), offline)
+	status := &driverStatus{}
+	assert.Nil(t, json.Unmarshal(retained[msg.buildDriverStatusTopic("iotd-edge", "driver")], status))
+	assert.Equal(t, offline, status.Status)
+	assert.Equal(t, []*driverDevice{{DeviceId: "iotd-test", ThingId: "iott-test"}}, status.Devices)
+	devices := &driverDevices{}
+	assert.Nil(t, json.Unmarshal(retained[msg.buildDriverDevicesTopic("iotd-edge", "driver")], devices))
+	assert.Equal(t, []*driverDevice{{DeviceId: "iotd-test", ThingId: "iott-test"}}, devices.Devices)
+}
+
+func TestRestoreDeclaredStatus(t *testing.T) {
+	client, fake, ctx, done := newTestClient(t)
+	defer done()
+	silent, err := NewEndClient(newTestToken(t, testTokenKey, time.Time{}), SetSession(client.(*endClient).session),
+		SetRestoreStatus(false))
+	assert.Nil(t, err)
+	assert.Nil(t, client.Online(ctx))
+	assert.Nil(t, silent.Online(ctx))
+	published := len(fake.messages())
+
+	client.(*endClient).restoreDeclaredStatus()
+	silent.(*endClient).restoreDeclaredStatus()
+	messages := fake.messages()[published:]
+	assert.Equal(t, 1, len(messages))
+	assert.Contains(t, string(messages[0].payload), online)
+}
+
+func TestReconnectSubscribe(t *testing.T) {
+	client, fake, ctx, done := newTestClient(t)
+	defer done()
+	session := client.(*endClient).session
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		device_id: "iotd-user",
+		thing_id:  userThingId,
+	}).SignedString(testTokenKey)
+	assert.Nil(t, err)
+	user, err := NewEndClient(token, SetSession(session))
+	assert.Nil(t, err)
+	assert.Nil(t, client.Online(ctx))
+	assert.Nil(t, user.Online(ctx))
+
+	//service topics are subscribed again on reconnect the same way as on online
+	fake.lock.Lock()
+	fake.handlers = nil
+	fake.lock.Unlock()
+	session.onConnect(fake)
+	var msg message
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	for _, topic := range []string{
+		msg.buildSetTopic("iotd-test", "iott-test"),
+		msg.buildGetTopic("iotd-test", "iott-test"),
+		fmt.Sprintf(deviceService, "iott-test", "iotd-test", "+"),
+		msg.buildUserServiceTopic("iotd-user", userThingId),
+	} {
+		assert.Contains(t, fake.handlers, topic)
+	}
+	assert.NotContains(t, fake.handlers, msg.buildSetTopic("iotd-user", userThingId))
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package edge_driver_go
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetadataError(t *testing.T) {
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	session := newTestSession(t, SetMetadataAddress(server.URL))
+
+	_, err := session.GetConfig()
+	var metaErr *MetadataError
+	assert.True(t, errors.As(err, &metaErr))
+	assert.Equal(t, http.StatusInternalServerError, metaErr.StatusCode)
+	assert.True(t, errors.Is(err, ErrMetadataUnavailable))
+
+	status = http.StatusNotFound
+	_, err = session.GetDeviceModel("iotd-test")
+	assert.True(t, errors.Is(err, ErrModelNotFound))
+	assert.False(t, errors.Is(err, ErrMetadataUnavailable))
+
+	server.Close()
+	_, err = session.GetDriverInfo()
+	assert.True(t, errors.Is(err, ErrMetadataUnavailable))
+}
+
+func TestSentinelErrors(t *testing.T) {
+	assert.True(t, errors.Is(ErrPublishTimeout, ErrTimeout))
+	assert.True(t, errors.Is(&ConnectError{Err: ErrSessionClosed}, ErrNotConnected))
+	assert.True(t, errors.Is(&ConnectError{Err: ErrSessionClosed}, ErrSessionClosed))
+
+	_, err := NewEndClient("", SetSession(newTestSession(t)))
+	assert.True(t, errors.Is(err, ErrTokenInvalid))
+	_, err = NewEndClient("malformed", SetSession(newTestSession(t)))
+	assert.True(t, errors.Is(err, ErrTokenInvalid))
+}
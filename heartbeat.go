@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package edge_driver_go
+
+import (
+	"context"
+	"time"
+)
+
+//start heartbeat loop if heartbeat is enabled and not running, stopped by stopHeartbeat or Close
+func (e *endClient) startHeartbeat() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.heartbeatInterval <= 0 || e.heartbeatCancel != nil || e.ctx.Err() != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(e.ctx)
+	e.heartbeatCancel = cancel
+	go e.heartbeat(ctx)
+}
+
+func (e *endClient) stopHeartbeat() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.heartbeatCancel != nil {
+		e.heartbeatCancel()
+		e.heartbeatCancel = nil
+	}
+}
+
+func (e *endClient) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(e.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		e.beat(ctx)
+	}
+}
+
+//run liveness probe and publish heartbeat, the device is reported offline after probe
+//fails the configured times in a row and online again once probe recovers
+func (e *endClient) beat(ctx context.Context) {
+	if e.probe != nil {
+		probeCtx, cancel := context.WithTimeout(ctx, e.heartbeatInterval)
+		err := e.probe(probeCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		e.lock.Lock()
+		previous := e.probeDown
+		if err != nil {
+			e.probeFailures++
+			if e.probeFailures >= e.probeThreshold {
+				e.probeDown = true
+			}
+		} else {
+			e.probeFailures = 0
+			e.probeDown = false
+		}
+		current := e.probeDown
+		e.lock.Unlock()
+		if current && !previous {
+			if e.logger != nil {
+				e.logger.Warn("[sdk] liveness probe failed, report offline:", e.config.DeviceId(), err.Error())
+			}
+			if err = e.publishStatus(offline); err != nil && e.logger != nil {
+				e.logger.Warn("[sdk] publish device status failed:", e.config.DeviceId(), err.Error())
+			}
+			return
+		}
+	}
+	if e.liveStatus() != online {
+		return
+	}
+	if err := e.publishStatus(online); err != nil && e.logger != nil {
+		e.logger.Warn("[sdk] publish heartbeat failed:", e.config.DeviceId(), err.Error())
+	}
+}
+
+//status to publish, offline while token is disabled or liveness probe is failing
+func (e *endClient) liveStatus() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.status == online && (e.tokenStatus == Disable || e.probeDown) {
+		return offline
+	}
+	return e.status
+}
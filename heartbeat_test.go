@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package edge_driver_go
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func statusOf(messages []*fakeMessage) []string {
+	result := make([]string, 0, len(messages))
+	for _, m := range messages {
+		if strings.Contains(string(m.payload), `"`+offline+`"`) {
+			result = append(result, offline)
+		} else {
+			result = append(result, online)
+		}
+	}
+	return result
+}
+
+func TestLivenessProbe(t *testing.T) {
+	var probeErr error
+	client, fake, ctx, done := newTestClient(t, SetHeartbeat(time.Hour), SetLivenessProbe(func(ctx context.Context) error {
+		return probeErr
+	}, 2))
+	defer done()
+	assert.Nil(t, client.Online(ctx))
+	e := client.(*endClient)
+	published := len(fake.messages())
+
+	e.beat(ctx)
+	probeErr = errors.New("modbus timeout")
+	e.beat(ctx)
+	e.beat(ctx)
+	e.beat(ctx)
+	probeErr = nil
+	e.beat(ctx)
+	assert.Equal(t, []string{online, online, offline, online}, statusOf(fake.messages()[published:]))
+	assert.Nil(t, client.Close(ctx))
+}
+
+func TestHeartbeat(t *testing.T) {
+	client, fake, ctx, done := newTestClient(t, SetHeartbeat(20*time.Millisecond))
+	defer done()
+	assert.Nil(t, client.Online(ctx))
+	time.Sleep(110 * time.Millisecond)
+	assert.Nil(t, client.Offline(ctx))
+	count := len(fake.messages())
+	assert.True(t, count >= 4)
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, count, len(fake.messages()))
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package edge_driver_go
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+//default max payload size of property history message
+const defaultMaxMessageSize = 128 * 1024
+
+//report several timestamped values of each property, samples are validated against thing model,
+//sorted by time and split into messages not larger than max message size
+func (e *endClient) ReportPropertyHistory(ctx context.Context, history map[string][]ValueData, tags Metadata) error {
+	ctx, receipt := newDelivery(ctx)
+	done := wait(func() error {
+		var (
+			topic string
+			msg   message
+			err   error
+		)
+		if history, err = e.validate.validatePropertyHistory(ctx, e.config.DeviceId(), history); err != nil {
+			return err
+		}
+		topic = msg.buildPropertyTopic(e.config.DeviceId(), e.config.ThingId())
+		for _, params := range splitHistory(history, e.maxMessageSize-e.historyOverhead(tags)) {
+			data := msg.buildPropertyBatchMsg(e.config.DeviceId(), e.config.ThingId(), params, tags)
+			if err = e.session.report(ctx, topic, data, e.policy(PropertyMessage)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	select {
+	case err := <-done:
+		receipt.fill()
+		return err
+	case <-ctx.Done():
+		receipt.fill()
+		return ErrPublishTimeout
+	}
+}
+
+//payload size of history message without params
+func (e *endClient) historyOverhead(tags Metadata) int {
+	var msg message
+	return len(msg.buildPropertyBatchMsg(e.config.DeviceId(), e.config.ThingId(), nil, tags))
+}
+
+//split samples in time order into params not larger than size, a sample larger than size is sent alone
+func splitHistory(history map[string][]ValueData, size int) []map[string][]property {
+	var (
+		samples []batchSample
+		result  []map[string][]property
+		current map[string][]property
+		used    int
+	)
+	now := time.Now().UnixNano() / 1e6
+	for k, values := range history {
+		for _, v := range values {
+			if v.Time == 0 {
+				v.Time = now
+			}
+			samples = append(samples, batchSample{id: k, value: v})
+		}
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		if samples[i].value.Time != samples[j].value.Time {
+			return samples[i].value.Time < samples[j].value.Time
+		}
+		return samples[i].id < samples[j].id
+	})
+	for _, s := range samples {
+		p := property{Value: s.value.Value, Time: s.value.Time}
+		value, _ := json.Marshal(p)
+		key, _ := json.Marshal(s.id)
+		cost := len(value) + 1
+		if _, ok := current[s.id]; !ok {
+			cost += len(key) + 4
+		}
+		if current != nil && used+cost > size {
+			result = append(result, current)
+			current = nil
+		}
+		if current == nil {
+			current = make(map[string][]property)
+			used = 0
+			cost = len(value) + 1 + len(key) + 4
+		}
+		current[s.id] = append(current[s.id], p)
+		used += cost
+	}
+	if current != nil {
+		result = append(result, current)
+	}
+	return result
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package edge_driver_go
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestReportPropertyHistory(t *testing.T) {
+	client, fake, ctx, done := newTestClient(t, SetValidateMode(ValidateStrict), SetMaxMessageSize(400))
+	defer done()
+
+	history := map[string][]ValueData{"name": {{Value: "a", Time: 5}}}
+	for i := 20; i > 0; i-- {
+		history["temp"] = append(history["temp"], ValueData{Value: i, Time: int64(i)})
+	}
+	assert.Nil(t, client.ReportPropertyHistory(ctx, history, Metadata{"source": "cache"}))
+	messages := fake.messages()
+	assert.True(t, len(messages) > 1)
+	var times []int64
+	for _, m := range messages {
+		assert.True(t, len(m.payload) <= 400)
+		var temp []property
+		assert.Nil(t, json.Unmarshal(batchParams(t, m)["temp"], &temp))
+		for _, p := range temp {
+			times = append(times, p.Time)
+		}
+	}
+	assert.Len(t, times, 20)
+	assert.Equal(t, int64(1), times[0])
+	assert.Equal(t, int64(20), times[19])
+
+	history["temp"] = append(history["temp"], ValueData{Value: 200, Time: 21})
+	err := client.ReportPropertyHistory(ctx, history, nil)
+	validateErr, ok := err.(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "temp[20]", validateErr.Fields[0].Field)
+	assert.Len(t, fake.messages(), len(messages))
+}
@@ -15,7 +15,10 @@
  */
 package edge_driver_go
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type ValueData struct {
 	Value interface{} `json:"value"`
@@ -35,6 +38,28 @@ type OnGetServiceCall func(args []string) (Metadata, error)
 //user service call
 type OnUserServiceCall func(data []byte) ([]byte, error)
 
+//service request info passed to context aware handlers
+type ServiceRequest struct {
+	Id       string //request id, empty for user service call
+	DeviceId string //device id
+	ThingId  string //thing id
+	Method   string //service identifier, base for property set and get
+	Payload  []byte //raw request payload
+}
+
+//context aware handlers, ctx is canceled when the call times out
+type OnEdgeServiceCallCtx func(ctx context.Context, req *ServiceRequest, args Metadata) (*Reply, error)
+type OnEndServiceCallCtx func(ctx context.Context, req *ServiceRequest, args Metadata) (*Reply, error)
+type OnSetServiceCallCtx func(ctx context.Context, req *ServiceRequest, args Metadata) error
+type OnGetServiceCallCtx func(ctx context.Context, req *ServiceRequest, args []string) (Metadata, error)
+type OnUserServiceCallCtx func(ctx context.Context, req *ServiceRequest, data []byte) ([]byte, error)
+
+//token expiry call, called before sub device token expires
+type OnTokenExpiry func(deviceId string, expiresAt time.Time)
+
+//device liveness probe, the device is alive if nil is returned
+type LivenessProbe func(ctx context.Context) error
+
 //config change call
 type ConfigChangeFunc func(t string, config []byte)
 
@@ -57,14 +82,35 @@ type Client interface {
 	//report device info to cloud
 	ReportDeviceInfo(ctx context.Context, params *DeviceMsg) error
 }
+
+//sub device interface extension, kept apart from Client so existing Client implementations still compile.
+//the client returned by NewEndClient implements it, use client.(ClientEx)
+type ClientEx interface {
+	Client
+	//report several timestamped values of each property, split into messages by max message size
+	ReportPropertyHistory(ctx context.Context, history map[string][]ValueData, tags Metadata) error
+	//queue device property samples, they are reported in batch if SetBatchReport is used
+	ReportPropertiesBatch(ctx context.Context, params MetadataMsg) error
+	//report queued property samples
+	Flush(ctx context.Context) error
+	//register service handler, args and reply data are checked against thing model if validate is set
+	HandleService(name string, handler OnEndServiceCallCtx, validate bool)
+	//list registered services
+	Services() []string
+	//unsubscribe device topics and remove it from session
+	Close(ctx context.Context) error
+}
 type ConnectLost func(err error)
+type Reconnect func()
 type messageArrived func(topic string, payload []byte)
 
 //describe device info
 type config interface {
-	DeviceId() string                 //device id
-	ThingId() string                  //thing id
-	Token() string                    //token
-	Services() []string               //services
-	Metadata() map[string]interface{} //device metadata
+	DeviceId() string                                //device id
+	ThingId() string                                 //thing id
+	Token() string                                   //token
+	ExpiresAt() time.Time                            //token expire time, zero if token never expires
+	update(token string, keyFunc TokenKeyFunc) error //update token
+	Services() []string                              //services
+	Metadata() map[string]interface{}                //device metadata
 }
@@ -39,6 +39,8 @@ const (
 	deviceInfoReport           = "/sys/%s/%s/thing/deviceinfo/post"
 	configChange               = "/iot/internal/%s/notify"
 	deviceDiscoveryReport      = "/sys/%s/device/discovery/post"
+	driverStatusReport         = "/as/mqtt/status/driver/%s/%s"
+	driverDevicesReport        = "/as/mqtt/status/driver/%s/%s/devices"
 )
 
 type message struct {
@@ -112,6 +114,43 @@ func (m message) buildHeartbeatMsg(deviceId, thingId, status string) []byte {
 	return buf
 }
 
+//build driver status topic
+func (m message) buildDriverStatusTopic(deviceId, driverId string) string {
+	return fmt.Sprintf(driverStatusReport, deviceId, driverId)
+}
+
+//build driver sub devices topic, it is not overwritten by the will message
+func (m message) buildDriverDevicesTopic(deviceId, driverId string) string {
+	return fmt.Sprintf(driverDevicesReport, deviceId, driverId)
+}
+
+//build registered sub devices of driver
+func (m message) buildDriverDevicesMsg(deviceId, thingId, driverId string, devices []*driverDevice) []byte {
+	data := &driverDevices{
+		DriverId: driverId,
+		DeviceId: deviceId,
+		ThingId:  thingId,
+		Devices:  devices,
+		Time:     time.Now().UnixNano() / 1e6,
+	}
+	buf, _ := json.Marshal(data)
+	return buf
+}
+
+// build driver status struct, devices are the registered sub devices of driver
+func (m message) buildDriverStatusMsg(deviceId, thingId, driverId, status string, devices []*driverDevice) []byte {
+	data := &driverStatus{
+		DriverId: driverId,
+		DeviceId: deviceId,
+		ThingId:  thingId,
+		Status:   status,
+		Devices:  devices,
+		Time:     time.Now().UnixNano() / 1e6,
+	}
+	buf, _ := json.Marshal(data)
+	return buf
+}
+
 //build device property data
 func (m message) buildPropertyMsg(deviceId, thingId string, meta Metadata) []byte {
 	id := uuid.NewV4().String()
@@ -197,6 +236,30 @@ func (m message) buildPropertyMsgWithTagsEx(deviceId, thingId string, meta Metad
 	return buf
 }
 
+//build device property data with several timestamped values of each property
+func (m message) buildPropertyBatchMsg(deviceId, thingId string, params map[string][]property, tags Metadata) []byte {
+	id := uuid.NewV4().String()
+	values := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		values[k] = v
+	}
+	message := &thingPropertyMsg{
+		Id:      id,
+		Version: messageVersion,
+		Type:    devicePropertyType,
+		Metadata: &messageMeta{
+			DeviceId:  deviceId,
+			ThingId:   thingId,
+			SourceId:  []string{deviceId},
+			EpochTime: time.Now().UnixNano() / 1e6,
+			Tags:      tags,
+		},
+		Params: values,
+	}
+	buf, _ := json.Marshal(message)
+	return buf
+}
+
 //build device info data
 func (m message) buildDiscoveryMsg(deviceId, thingId string, meta Metadata) []byte {
 	id := uuid.NewV4().String()
@@ -260,7 +323,7 @@ func (m message) buildEventMsg(deviceId, thingId string, eventName string, meta
 func (m message) parseServiceMethod(topic string) (string, string, error) {
 	kv := strings.Split(topic, "/")
 	if len(kv) != edgeServiceLen {
-		return "", "", topicError
+		return "", "", ErrInvalidTopic
 	}
 	return kv[2], kv[6], nil
 }
@@ -269,7 +332,7 @@ func (m message) parseServiceMethod(topic string) (string, string, error) {
 func (m message) parseConfigType(topic string) (string, error) {
 	kv := strings.Split(topic, "/")
 	if len(kv) != configLen {
-		return "", topicError
+		return "", ErrInvalidTopic
 	}
 	return kv[4], nil
 }
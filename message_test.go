@@ -0,0 +1,57 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package edge_driver_go
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBuildDriverStatusMsg(t *testing.T) {
+	var msg message
+	assert.Equal(t, "/as/mqtt/status/driver/iotd-edge/driver", msg.buildDriverStatusTopic("iotd-edge", "driver"))
+	buf := msg.buildDriverStatusMsg("iotd-edge", "iott-edge", "driver", offline, []*driverDevice{
+		{DeviceId: "iotd-1", ThingId: "iott-1"},
+	})
+	status := &driverStatus{}
+	assert.Nil(t, json.Unmarshal(buf, status))
+	assert.Equal(t, "driver", status.DriverId)
+	assert.Equal(t, offline, status.Status)
+	assert.Equal(t, 1, len(status.Devices))
+	assert.Equal(t, "iotd-1", status.Devices[0].DeviceId)
+}
+
+func TestServiceReplyError(t *testing.T) {
+	resp := &serviceReply{Id: "1", Code: RpcSuccess}
+	resp.setError(fmt.Errorf("call: %w", &ServiceError{Code: RpcDeviceBusy, Message: "busy", Details: "retry later"}))
+	assert.Equal(t, RpcDeviceBusy, resp.Code)
+	assert.Equal(t, "busy", resp.Message)
+	assert.Equal(t, "retry later", resp.Details)
+
+	resp.setError(&ValidationError{DeviceId: "iotd-test", Fields: []*FieldError{{Field: "delay", Reason: "not a number", Value: "x"}}})
+	assert.Equal(t, RpcInvalidParams, resp.Code)
+	buf, err := json.Marshal(resp)
+	assert.Nil(t, err)
+	assert.Contains(t, string(buf), `"details":[{"field":"delay","reason":"not a number","value":"x"}]`)
+
+	resp.setError(errors.New("failed"))
+	assert.Equal(t, RpcFail, resp.Code)
+	assert.Equal(t, "failed", resp.Message)
+}
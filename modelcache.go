@@ -0,0 +1,98 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package edge_driver_go
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type modelItem struct {
+	model   *ThingModel
+	expires time.Time //model is fetched again after expires
+}
+
+//model fetch in flight, concurrent misses of the same device wait for it
+type modelCall struct {
+	done  chan struct{}
+	model *ThingModel
+	stale bool
+	err   error
+}
+
+//thing model cache of devices, the last known model is kept as fallback
+type modelCache struct {
+	ttl   time.Duration
+	fetch func(id string) (*ThingModel, error)
+	lock  sync.Mutex
+	items map[string]*modelItem
+	calls map[string]*modelCall
+}
+
+func newModelCache(ttl time.Duration, fetch func(id string) (*ThingModel, error)) *modelCache {
+	return &modelCache{
+		ttl:   ttl,
+		fetch: fetch,
+		items: make(map[string]*modelItem),
+		calls: make(map[string]*modelCall),
+	}
+}
+
+//get cached model, fetch it when expired. the last known model is returned if metadata service
+//is unavailable, other fetch errors are returned. a device is fetched once at a time, concurrent
+//gets share the result
+func (c *modelCache) get(id string) (*ThingModel, bool, error) {
+	c.lock.Lock()
+	item, ok := c.items[id]
+	if ok && time.Now().Before(item.expires) {
+		c.lock.Unlock()
+		return item.model, false, nil
+	}
+	if call, running := c.calls[id]; running {
+		c.lock.Unlock()
+		<-call.done
+		return call.model, call.stale, call.err
+	}
+	call := &modelCall{done: make(chan struct{})}
+	c.calls[id] = call
+	c.lock.Unlock()
+
+	model, err := c.fetch(id)
+	c.lock.Lock()
+	switch {
+	case err == nil:
+		call.model = model
+		c.items[id] = &modelItem{model: model, expires: time.Now().Add(c.ttl)}
+	case ok && errors.Is(err, ErrMetadataUnavailable):
+		call.model, call.stale, call.err = item.model, true, err
+	default:
+		call.err = err
+	}
+	delete(c.calls, id)
+	c.lock.Unlock()
+	close(call.done)
+	return call.model, call.stale, call.err
+}
+
+//expire all cached models, they are kept for fallback
+func (c *modelCache) invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for id, item := range c.items {
+		c.items[id] = &modelItem{model: item.model}
+	}
+}
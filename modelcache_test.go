@@ -0,0 +1,128 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package edge_driver_go
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestModelCache(t *testing.T) {
+	var (
+		fetched int
+		fail    error
+	)
+	cache := newModelCache(time.Minute, func(id string) (*ThingModel, error) {
+		fetched++
+		if fail != nil {
+			return nil, fail
+		}
+		return &ThingModel{Properties: map[string]*Property{"temp": {Identifier: "temp"}}}, nil
+	})
+	model, stale, err := cache.get("iotd-test")
+	assert.Nil(t, err)
+	assert.False(t, stale)
+	assert.Contains(t, model.Properties, "temp")
+	_, _, err = cache.get("iotd-test")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, fetched)
+
+	cache.invalidate()
+	fail = &MetadataError{Url: "metadata", Err: errors.New("connection refused")}
+	model, stale, err = cache.get("iotd-test")
+	assert.Equal(t, fail, err)
+	assert.True(t, stale)
+	assert.Contains(t, model.Properties, "temp")
+	assert.Equal(t, 2, fetched)
+
+	_, _, err = cache.get("iotd-other")
+	assert.Equal(t, fail, err)
+
+	//last known model is not used for a removed device
+	fail = &MetadataError{Url: "metadata", StatusCode: 404, Err: ErrModelNotFound}
+	model, stale, err = cache.get("iotd-test")
+	assert.True(t, errors.Is(err, ErrModelNotFound))
+	assert.False(t, stale)
+	assert.Nil(t, model)
+}
+
+func TestModelCacheInvalidateRace(t *testing.T) {
+	cache := newModelCache(time.Minute, func(id string) (*ThingModel, error) {
+		return newThingModel(), nil
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			cache.invalidate()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		_, _, err := cache.get("iotd-test")
+		assert.Nil(t, err)
+	}
+	<-done
+}
+
+func TestSessionModelCache(t *testing.T) {
+	server := newTestModelServer()
+	session := newTestSession(t, SetMetadataAddress(server.URL))
+	model, err := session.getModel("iotd-test")
+	assert.Nil(t, err)
+	assert.Contains(t, model.Properties, "temp")
+	server.Close()
+	model, err = session.getModel("iotd-test")
+	assert.Nil(t, err)
+	assert.Contains(t, model.Properties, "temp")
+	session.onConfigChange(SubDeviceChanged, nil)
+	model, err = session.getModel("iotd-test")
+	assert.Nil(t, err)
+	assert.Contains(t, model.Properties, "temp")
+}
+
+func TestModelCacheSingleFlight(t *testing.T) {
+	var fetched int32
+	release := make(chan struct{})
+	cache := newModelCache(time.Minute, func(id string) (*ThingModel, error) {
+		atomic.AddInt32(&fetched, 1)
+		<-release
+		return newThingModel(), nil
+	})
+	var wg sync.WaitGroup
+	models := make([]*ThingModel, 10)
+	for i := range models {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			model, _, err := cache.get("iotd-test")
+			assert.Nil(t, err)
+			models[i] = model
+		}(i)
+	}
+	//concurrent misses of the same device wait for one fetch
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetched))
+	for _, model := range models {
+		assert.True(t, model == models[0])
+	}
+}
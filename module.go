@@ -17,148 +17,356 @@ package edge_driver_go
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"strings"
 )
 
 //report discovery device (supported device type is onvif)
 func ReportDiscovery(ctx context.Context, deviceType string, meta Metadata) error {
+	s, err := DefaultSession()
+	if err != nil {
+		return err
+	}
+	return s.ReportDiscovery(ctx, deviceType, meta)
+}
+
+//get edge sub device list
+func GetConfig() (config []*SubDeviceInfo, err error) {
+	s, err := DefaultSession()
+	if err != nil {
+		return nil, err
+	}
+	return s.GetConfig()
+}
+
+//get edge sub driver info
+func GetDriverInfo() (info string, err error) {
+	s, err := DefaultSession()
+	if err != nil {
+		return "", err
+	}
+	return s.GetDriverInfo()
+}
+
+//get device thing model by device id
+func GetDeviceModel(id string) (info *ThingModel, err error) {
+	s, err := DefaultSession()
+	if err != nil {
+		return nil, err
+	}
+	return s.GetDeviceModel(id)
+}
+
+//register edge device service
+func RegisterEdgeService(serviceId string, call OnEdgeServiceCall) (err error) {
+	s, err := DefaultSession()
+	if err != nil {
+		return err
+	}
+	return s.RegisterEdgeService(serviceId, call)
+}
+
+//register edge device service with context aware handler
+func RegisterEdgeServiceCtx(serviceId string, call OnEdgeServiceCallCtx) (err error) {
+	s, err := DefaultSession()
+	if err != nil {
+		return err
+	}
+	return s.RegisterEdgeServiceCtx(serviceId, call)
+}
+
+//unregister edge device service
+func UnregisterEdgeService(serviceId string) error {
+	s, err := DefaultSession()
+	if err != nil {
+		return err
+	}
+	return s.UnregisterEdgeService(serviceId)
+}
+
+//report edge device property
+func ReportEdgeProperties(ctx context.Context, params Metadata) (err error) {
+	s, err := DefaultSession()
+	if err != nil {
+		return err
+	}
+	return s.ReportEdgeProperties(ctx, params)
+}
+
+//report edge device event
+func ReportEdgeEvent(ctx context.Context, eventId string, params Metadata) (err error) {
+	s, err := DefaultSession()
+	if err != nil {
+		return err
+	}
+	return s.ReportEdgeEvent(ctx, eventId, params)
+}
+
+//set lost call
+func SetConnectLost(call ConnectLost) {
+	if s, err := DefaultSession(); err == nil {
+		s.SetConnectLost(call)
+	}
+}
+
+//set config change call
+func SetConfigChange(call ConfigChangeFunc) {
+	if s, err := DefaultSession(); err == nil {
+		s.SetConfigChange(call)
+	}
+}
+
+//report discovery device (supported device type is onvif)
+func (s *Session) ReportDiscovery(ctx context.Context, deviceType string, meta Metadata) error {
+	ctx, receipt := newDelivery(ctx)
 	done := wait(func() error {
 		var (
 			topic string
 			msg   message
 			data  []byte
 		)
-		meta["driver_id"] = getSessionIns().getDriverId()
-		meta["device_id"] = getSessionIns().getDeviceId()
-		meta["version"] = getSessionIns().getDriverVersion()
+		meta["driver_id"] = s.getDriverId()
+		meta["device_id"] = s.getDeviceId()
+		meta["version"] = s.getDriverVersion()
 		topic = msg.buildDiscoveryTopic(deviceType)
-		data = msg.buildDiscoveryMsg(getSessionIns().getDeviceId(), getSessionIns().getThingId(), meta)
-		return getSessionIns().publish(topic, data)
+		data = msg.buildDiscoveryMsg(s.getDeviceId(), s.getThingId(), meta)
+		return s.publishCtx(ctx, topic, data, s.policy(OtherMessage))
 	})
 	select {
 	case err := <-done:
+		receipt.fill()
 		return err
 	case <-ctx.Done():
-		return rpcTimeout
+		receipt.fill()
+		return ErrPublishTimeout
 	}
-	return nil
 }
 
 //get edge sub device list
-func GetConfig() (config []*SubDeviceInfo, err error) {
-	return getSessionIns().getConfig()
+func (s *Session) GetConfig() (config []*SubDeviceInfo, err error) {
+	return s.getConfig()
 }
 
 //get edge sub driver info
-func GetDriverInfo() (info string, err error) {
-	return getSessionIns().getDriver()
+func (s *Session) GetDriverInfo() (info string, err error) {
+	return s.getDriver()
 }
 
 //get device thing model by device id
-func GetDeviceModel(id string) (info *ThingModel, err error) {
-	return getSessionIns().getModel(id)
+func (s *Session) GetDeviceModel(id string) (info *ThingModel, err error) {
+	return s.getModel(id)
 }
 
-//register edge device service
-func RegisterEdgeService(serviceId string, call OnEdgeServiceCall) (err error) {
-	var (
-		msg    message
-		req    *serviceRequest
-		reply  *Reply
-		resp   *serviceReply
-		buf    []byte
-		logger Logger
-		//methodName string
-	)
-	logger = newLogger()
-	err = getSessionIns().subscribes(msg.buildServiceTopic(getSessionIns().getDeviceId(), getSessionIns().getThingId(), []string{serviceId}), func(topic string, payload []byte) {
-		defer func() {
-			if err != nil {
-				logger.Error(topic, err.Error())
-			}
-		}()
-		req, err = msg.parseResponseMsg(payload)
+//token verify key fetched from metadata service, PEM encoded public key for RSA and ECDSA,
+//or secret for HMAC. tokens signed by a method not matching the key type are rejected. use with SetTokenKeyFunc
+func (s *Session) MetadataTokenKey() TokenKeyFunc {
+	return func(alg string, claims map[string]interface{}) (interface{}, error) {
+		key, err := s.getTokenKey()
 		if err != nil {
-			return
+			return nil, err
+		}
+		return tokenKeyFor(alg, key)
+	}
+}
+
+//parse token verify key, PEM content must be a RSA or ECDSA public key, other content is HMAC secret
+func parseTokenKey(content []byte) (interface{}, error) {
+	if block, _ := pem.Decode(content); block == nil {
+		return content, nil
+	}
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(content); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(content); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("token key is not a RSA or ECDSA public key")
+}
+
+//check token signing method against key type, so a public key is never used as HMAC secret
+func tokenKeyFor(alg string, key interface{}) (interface{}, error) {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS") {
+			return key, nil
 		}
-		resp = &serviceReply{
-			Id:   req.Id,
-			Code: RpcSuccess,
-			Data: make(Metadata),
+	case *ecdsa.PublicKey:
+		if strings.HasPrefix(alg, "ES") {
+			return key, nil
 		}
-		if call != nil {
-			if reply, err = call(req.Params); err != nil {
-				resp.Code = RpcFail
-			} else {
-				resp.Code = reply.Code
-				resp.Data = reply.Data
-			}
-			buf, err = json.Marshal(resp)
-			if err != nil {
-				return
-			}
-			if err = getSessionIns().publish(topic+"_reply", buf); err != nil {
-				logger.Error(fmt.Sprintf("edge requestServiceReply err:%s", err.Error()))
-			} else {
-				logger.Error(fmt.Sprintf("edge requestServiceReply  topic:%s,data:%s", topic+"_reply", string(buf)))
-			}
-		} else {
-			logger.Warn("edge callback not set")
+	case []byte:
+		if strings.HasPrefix(alg, "HS") {
+			return key, nil
 		}
+	}
+	return nil, fmt.Errorf("token signing method %s doesn't match key type %T", alg, key)
+}
+
+//register edge device service
+func (s *Session) RegisterEdgeService(serviceId string, call OnEdgeServiceCall) (err error) {
+	if call == nil {
+		return s.RegisterEdgeServiceCtx(serviceId, nil)
+	}
+	return s.RegisterEdgeServiceCtx(serviceId, func(ctx context.Context, req *ServiceRequest, args Metadata) (*Reply, error) {
+		return call(args)
 	})
-	if err != nil {
-		return err
+}
+
+//register edge device service with context aware handler
+func (s *Session) RegisterEdgeServiceCtx(serviceId string, call OnEdgeServiceCallCtx) (err error) {
+	var msg message
+	handler := func(topic string, payload []byte) {
+		if s.dispatch(s.getDeviceId(), func(ctx context.Context) {
+			s.edgeCall(ctx, topic, payload, serviceId, call)
+		}) {
+			return
+		}
+		if req, err := msg.parseResponseMsg(payload); err == nil {
+			s.edgeServiceReply(topic, &serviceReply{
+				Id:      req.Id,
+				Code:    RpcDeviceBusy,
+				Data:    make(Metadata),
+				Message: "device busy",
+			})
+		}
+	}
+	//kept subscription is restored on reconnect
+	for _, topic := range msg.buildServiceTopic(s.getDeviceId(), s.getThingId(), []string{serviceId}) {
+		if err = s.subscribeKeep(topic, s.policy(SubscribeMessage).qos, handler); err != nil {
+			return err
+		}
 	}
+	s.edgeLock.Lock()
+	s.edgeServices[serviceId] = call
+	s.edgeLock.Unlock()
 	return nil
 }
 
+//unregister edge device service
+func (s *Session) UnregisterEdgeService(serviceId string) error {
+	var msg message
+	s.edgeLock.Lock()
+	delete(s.edgeServices, serviceId)
+	s.edgeLock.Unlock()
+	return s.unsubscribeKeep(msg.buildServiceTopic(s.getDeviceId(), s.getThingId(), []string{serviceId})...)
+}
+
+func (s *Session) edgeCall(ctx context.Context, topic string, payload []byte, serviceId string, call OnEdgeServiceCallCtx) {
+	var (
+		msg   message
+		req   *serviceRequest
+		reply *Reply
+		resp  *serviceReply
+		err   error
+	)
+	defer func() {
+		if err != nil && s.logger != nil {
+			s.logger.Error(topic, err.Error())
+		}
+	}()
+	req, err = msg.parseResponseMsg(payload)
+	if err != nil {
+		return
+	}
+	resp = &serviceReply{
+		Id:   req.Id,
+		Code: RpcSuccess,
+		Data: make(Metadata),
+	}
+	if call == nil {
+		if s.logger != nil {
+			s.logger.Warn("edge callback not set")
+		}
+		return
+	}
+	request := &ServiceRequest{
+		Id:       req.Id,
+		DeviceId: s.getDeviceId(),
+		ThingId:  s.getThingId(),
+		Method:   serviceId,
+		Payload:  payload,
+	}
+	if err = callWithContext(ctx, func() (err error) {
+		reply, err = call(ctx, request, req.Params)
+		return
+	}); err != nil {
+		resp.setError(err)
+	} else if reply == nil {
+		resp.Code = RpcFail
+	} else {
+		resp.Code = reply.Code
+		resp.Data = reply.Data
+		resp.Message = reply.Message
+	}
+	s.edgeServiceReply(topic, resp)
+}
+
+//publish edge service reply
+func (s *Session) edgeServiceReply(topic string, resp *serviceReply) {
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		if s.logger != nil {
+			s.logger.Error(fmt.Sprintf("edge requestServiceReply err:%s", err.Error()))
+		}
+		return
+	}
+	if err = s.publish(topic+"_reply", buf, s.policy(ServiceReplyMessage)); err != nil {
+		if s.logger != nil {
+			s.logger.Error(fmt.Sprintf("edge requestServiceReply err:%s", err.Error()))
+		}
+	} else if s.logger != nil {
+		s.logger.Info(fmt.Sprintf("edge requestServiceReply  topic:%s,data:%s", topic+"_reply", string(buf)))
+	}
+}
+
 //report edge device property
-func ReportEdgeProperties(ctx context.Context, params Metadata) (err error) {
+func (s *Session) ReportEdgeProperties(ctx context.Context, params Metadata) (err error) {
+	ctx, receipt := newDelivery(ctx)
 	done := wait(func() error {
 		var (
 			topic string
 			msg   message
 			data  []byte
 		)
-		topic = msg.buildPropertyTopic(getSessionIns().getDeviceId(), getSessionIns().getThingId())
-		data = msg.buildPropertyMsg(getSessionIns().getDeviceId(), getSessionIns().getThingId(), params)
-		return getSessionIns().publish(topic, data)
+		topic = msg.buildPropertyTopic(s.getDeviceId(), s.getThingId())
+		data = msg.buildPropertyMsg(s.getDeviceId(), s.getThingId(), params)
+		return s.report(ctx, topic, data, s.policy(PropertyMessage))
 	})
 	select {
 	case err := <-done:
+		receipt.fill()
 		return err
 	case <-ctx.Done():
-		return rpcTimeout
+		receipt.fill()
+		return ErrPublishTimeout
 	}
 }
 
 //report edge device event
-func ReportEdgeEvent(ctx context.Context, eventId string, params Metadata) (err error) {
+func (s *Session) ReportEdgeEvent(ctx context.Context, eventId string, params Metadata) (err error) {
+	ctx, receipt := newDelivery(ctx)
 	done := wait(func() error {
 		var (
 			topic string
 			msg   message
 			data  []byte
 		)
-		topic = msg.buildEventTopic(getSessionIns().getDeviceId(), getSessionIns().getThingId(), eventId)
-		data = msg.buildEventMsg(getSessionIns().getDeviceId(), getSessionIns().getThingId(), eventId, params)
-		return getSessionIns().publish(topic, data)
+		topic = msg.buildEventTopic(s.getDeviceId(), s.getThingId(), eventId)
+		data = msg.buildEventMsg(s.getDeviceId(), s.getThingId(), eventId, params)
+		return s.report(ctx, topic, data, s.policy(EventMessage))
 	})
 	select {
 	case err := <-done:
+		receipt.fill()
 		return err
 	case <-ctx.Done():
-		return rpcTimeout
+		receipt.fill()
+		return ErrPublishTimeout
 	}
 }
-
-//set lost call
-func SetConnectLost(call ConnectLost) {
-	getSessionIns().setConnectLost(call)
-}
-
-//set config change call
-func SetConfigChange(call ConfigChangeFunc) {
-	getSessionIns().setConfigChange(call)
-}
@@ -19,14 +19,23 @@ import (
 	"context"
 	"github.com/stretchr/testify/assert"
 	"math/rand"
+	"os"
 	"testing"
 	"time"
 )
 
 func TestMain(m *testing.M) {
+	os.Exit(m.Run())
+}
 
+//skip test running against live hub and metadata service unless EDGE_INTEGRATION_TEST is set
+func integrationTest(t *testing.T) {
+	if os.Getenv("EDGE_INTEGRATION_TEST") == "" {
+		t.Skip("set EDGE_INTEGRATION_TEST to run against live hub and metadata service")
+	}
 }
 func TestRegisterEdgeService(t *testing.T) {
+	integrationTest(t)
 	err := RegisterEdgeService("xxxx", func(args Metadata) (reply *Reply, e error) {
 		return
 	})
@@ -39,6 +48,7 @@ func TestRegisterEdgeService(t *testing.T) {
 }
 
 func TestGetConfig(t *testing.T) {
+	integrationTest(t)
 	res, err := GetConfig()
 	assert.Nil(t, err)
 	for _, v := range res {
@@ -46,16 +56,19 @@ func TestGetConfig(t *testing.T) {
 	}
 }
 func TestGetDriverInfo(t *testing.T) {
+	integrationTest(t)
 	res, err := GetDriverInfo()
 	assert.Nil(t, err)
 	t.Log(res)
 }
 func TestGetDeviceModel(t *testing.T) {
+	integrationTest(t)
 	res, err := GetDeviceModel("iotd-0adf702f-8c1c-489e-bde0-01788ac674c3")
 	assert.Nil(t, err)
 	t.Log(res)
 }
 func TestDiscovery(t *testing.T) {
+	integrationTest(t)
 	err := ReportDiscovery(context.Background(), "onvif", Metadata{"name": "hello world"})
 	assert.Nil(t, err)
 }
@@ -15,6 +15,12 @@
  */
 package edge_driver_go
 
+import (
+	"context"
+	"crypto/tls"
+	"time"
+)
+
 var defaultServerOptions = options{
 	//edgeServiceCall: nil,
 	endServiceCall:  nil,
@@ -22,16 +28,39 @@ var defaultServerOptions = options{
 	setServiceCall:  nil,
 	getServiceCall:  nil,
 	logger:          newLogger(),
+	session:         nil,
+	restoreStatus:   true,
+	maxMessageSize:  defaultMaxMessageSize,
 }
 
 type options struct {
 	//module Module
 	//edgeServiceCall OnEdgeServiceCall 			//service call func
-	endServiceCall  OnEndServiceCall  //service call func
-	userServiceCall OnUserServiceCall //user service call func
-	setServiceCall  OnSetServiceCall  //set service call func
-	getServiceCall  OnGetServiceCall  //get service call func
-	logger          Logger            //logger
+	endServiceCall    OnEndServiceCallCtx      //service call func
+	userServiceCall   OnUserServiceCallCtx     //user service call func
+	setServiceCall    OnSetServiceCallCtx      //set service call func
+	getServiceCall    OnGetServiceCallCtx      //get service call func
+	logger            Logger                   //logger
+	session           *Session                 //bind session, default session if nil
+	qos               [messageClassCount]*byte //qos override of message class
+	retained          [messageClassCount]*bool //retain override of message class
+	tokenKeyFunc      TokenKeyFunc             //token verify key, signature is not verified if nil
+	tokenExpiryBefore time.Duration            //token expiry call is called before token expires
+	tokenExpiryCall   OnTokenExpiry            //token expiry call
+	validateMode      ValidateMode             //property validate mode
+	restoreStatus     bool                     //republish declared status after reconnect
+	heartbeatInterval time.Duration            //heartbeat interval, disabled if 0
+	probe             LivenessProbe            //liveness probe
+	probeThreshold    int                      //probe failures to report offline
+	batch             *BatchOptions            //batch property report, disabled if nil
+	changes           *changeOptions           //report on change, disabled if nil
+	maxMessageSize    int                      //max payload size of property history message
+}
+
+//report on change options
+type changeOptions struct {
+	defaults ChangeFilter
+	filters  map[string]ChangeFilter
 }
 
 type ServerOption interface {
@@ -53,21 +82,61 @@ func newFuncServerOption(f func(*options)) *funcOption {
 }
 
 func SetSetServiceCall(call OnSetServiceCall) ServerOption {
+	if call == nil {
+		return SetSetServiceCallCtx(nil)
+	}
+	return SetSetServiceCallCtx(func(ctx context.Context, req *ServiceRequest, args Metadata) error {
+		return call(args)
+	})
+}
+func SetGetServiceCall(call OnGetServiceCall) ServerOption {
+	if call == nil {
+		return SetGetServiceCallCtx(nil)
+	}
+	return SetGetServiceCallCtx(func(ctx context.Context, req *ServiceRequest, args []string) (Metadata, error) {
+		return call(args)
+	})
+}
+func SetEndServiceCall(call OnEndServiceCall) ServerOption {
+	if call == nil {
+		return SetEndServiceCallCtx(nil)
+	}
+	return SetEndServiceCallCtx(func(ctx context.Context, req *ServiceRequest, args Metadata) (*Reply, error) {
+		return call(req.Method, args)
+	})
+}
+func SetUserServiceCall(call OnUserServiceCall) ServerOption {
+	if call == nil {
+		return SetUserServiceCallCtx(nil)
+	}
+	return SetUserServiceCallCtx(func(ctx context.Context, req *ServiceRequest, data []byte) ([]byte, error) {
+		return call(data)
+	})
+}
+
+//context aware set property handler
+func SetSetServiceCallCtx(call OnSetServiceCallCtx) ServerOption {
 	return newFuncServerOption(func(i *options) {
 		i.setServiceCall = call
 	})
 }
-func SetGetServiceCall(call OnGetServiceCall) ServerOption {
+
+//context aware get property handler
+func SetGetServiceCallCtx(call OnGetServiceCallCtx) ServerOption {
 	return newFuncServerOption(func(i *options) {
 		i.getServiceCall = call
 	})
 }
-func SetEndServiceCall(call OnEndServiceCall) ServerOption {
+
+//context aware service call handler
+func SetEndServiceCallCtx(call OnEndServiceCallCtx) ServerOption {
 	return newFuncServerOption(func(i *options) {
 		i.endServiceCall = call
 	})
 }
-func SetUserServiceCall(call OnUserServiceCall) ServerOption {
+
+//context aware user service call handler
+func SetUserServiceCallCtx(call OnUserServiceCallCtx) ServerOption {
 	return newFuncServerOption(func(i *options) {
 		i.userServiceCall = call
 	})
@@ -79,3 +148,285 @@ func SetLogger(logger Logger) ServerOption {
 		i.logger = logger
 	})
 }
+
+//set mqtt qos (0, 1 or 2) of end client message class, overrides session qos
+func SetClientQoS(class MessageClass, qos byte) ServerOption {
+	return newFuncServerOption(func(i *options) {
+		if class >= 0 && class < messageClassCount {
+			i.qos[class] = &qos
+		}
+	})
+}
+
+//set mqtt retain flag of end client message class, overrides session retain flag
+func SetClientRetained(class MessageClass, retained bool) ServerOption {
+	return newFuncServerOption(func(i *options) {
+		if class >= 0 && class < messageClassCount {
+			i.retained[class] = &retained
+		}
+	})
+}
+
+//verify token signature with key, []byte for HMAC, *rsa.PublicKey for RSA and *ecdsa.PublicKey for ECDSA
+func SetTokenKey(key interface{}) ServerOption {
+	return newFuncServerOption(func(i *options) {
+		i.tokenKeyFunc = func(alg string, claims map[string]interface{}) (interface{}, error) {
+			return key, nil
+		}
+	})
+}
+
+//verify token signature with key returned by call, see Session.MetadataTokenKey
+func SetTokenKeyFunc(call TokenKeyFunc) ServerOption {
+	return newFuncServerOption(func(i *options) {
+		i.tokenKeyFunc = call
+	})
+}
+
+//set token expiry call, call is called the duration before token expires
+func SetTokenExpiryCall(before time.Duration, call OnTokenExpiry) ServerOption {
+	return newFuncServerOption(func(i *options) {
+		i.tokenExpiryBefore = before
+		i.tokenExpiryCall = call
+	})
+}
+
+//set property validate mode, ValidateLenient if not set
+func SetValidateMode(mode ValidateMode) ServerOption {
+	return newFuncServerOption(func(i *options) {
+		i.validateMode = mode
+	})
+}
+
+//republish status declared by Online or Offline after hub reconnect, enabled by default
+func SetRestoreStatus(enabled bool) ServerOption {
+	return newFuncServerOption(func(i *options) {
+		i.restoreStatus = enabled
+	})
+}
+
+//publish online heartbeat at interval while the device is declared online, disabled by default
+func SetHeartbeat(interval time.Duration) ServerOption {
+	return newFuncServerOption(func(i *options) {
+		i.heartbeatInterval = interval
+	})
+}
+
+//run probe before each heartbeat, the device is reported offline after probe fails
+//failures times in a row and online again once probe succeeds. it requires SetHeartbeat
+func SetLivenessProbe(probe LivenessProbe, failures int) ServerOption {
+	return newFuncServerOption(func(i *options) {
+		if failures <= 0 {
+			failures = 1
+		}
+		i.probe = probe
+		i.probeThreshold = failures
+	})
+}
+
+//accumulate samples of ReportPropertiesBatch and report them together, see BatchOptions
+func SetBatchReport(opts BatchOptions) ServerOption {
+	return newFuncServerOption(func(i *options) {
+		i.batch = &opts
+	})
+}
+
+//report properties only when they changed, defaults applies to properties without filter or
+//thing model ext settings (deadband, deadband_percent, max_silence in seconds)
+func SetReportOnChange(defaults ChangeFilter, filters map[string]ChangeFilter) ServerOption {
+	return newFuncServerOption(func(i *options) {
+		i.changes = &changeOptions{
+			defaults: defaults,
+			filters:  filters,
+		}
+	})
+}
+
+//max payload bytes of messages split by ReportPropertyHistory, default 128KB
+func SetMaxMessageSize(size int) ServerOption {
+	return newFuncServerOption(func(i *options) {
+		if size > 0 {
+			i.maxMessageSize = size
+		}
+	})
+}
+
+//bind end client to session, the default session is used if not set
+func SetSession(session *Session) ServerOption {
+	return newFuncServerOption(func(i *options) {
+		i.session = session
+	})
+}
+
+var defaultSessionOptions = sessionOptions{
+	logger:  newLogger(),
+	backoff: defaultBackoff,
+	policies: func() (p [messageClassCount]publishPolicy) {
+		//late subscribers see the last device status
+		p[StatusMessage].retained = true
+		return
+	}(),
+	driverWill: true,
+	modelTTL:   5 * time.Minute,
+}
+
+type sessionOptions struct {
+	driverId        string        //driver id, EDGE_APP_ID if not set
+	clientId        string        //hub client id, edge.go.{edge device id}.{driver id} if not set
+	deviceId        string        //edge device id, EDGE_DEVICE_ID if not set
+	thingId         string        //edge thing id, EDGE_THING_ID if not set
+	hubAddress      string        //hub broker address, EDGE_HUB_HOST and EDGE_HUB_PORT if not set
+	metadataAddress string        //metadata service address, EDGE_META_ADDRESS if not set
+	logger          Logger        //logger
+	backoff         Backoff       //hub connect retry backoff
+	queue           *QueueOptions //offline report queue, disabled if nil
+	policies        [messageClassCount]publishPolicy
+	driverWill      bool               //publish driver status and set mqtt will message
+	tlsOptions      TLSOptions         //hub tls options, EDGE_HUB_TLS_* if not set
+	tlsConfig       *tls.Config        //hub tls config, overrides tls options
+	credentials     CredentialsFunc    //hub credentials, EDGE_HUB_USERNAME, EDGE_HUB_PASSWORD(_FILE) if not set
+	modelTTL        time.Duration      //thing model cache ttl
+	dispatcher      *DispatcherOptions //service call dispatcher, disabled if nil
+}
+
+type SessionOption interface {
+	apply(*sessionOptions)
+}
+
+type funcSessionOption struct {
+	f func(*sessionOptions)
+}
+
+func (fdo *funcSessionOption) apply(do *sessionOptions) {
+	fdo.f(do)
+}
+
+func newFuncSessionOption(f func(*sessionOptions)) *funcSessionOption {
+	return &funcSessionOption{
+		f: f,
+	}
+}
+
+//set driver id
+func SetDriverId(id string) SessionOption {
+	return newFuncSessionOption(func(i *sessionOptions) {
+		i.driverId = id
+	})
+}
+
+//set hub client id, it must be unique among sessions connected to the hub.
+//edge.go.{edge device id}.{driver id} is used if not set
+func SetClientId(id string) SessionOption {
+	return newFuncSessionOption(func(i *sessionOptions) {
+		i.clientId = id
+	})
+}
+
+//set edge device id and thing id
+func SetEdgeDevice(deviceId, thingId string) SessionOption {
+	return newFuncSessionOption(func(i *sessionOptions) {
+		i.deviceId = deviceId
+		i.thingId = thingId
+	})
+}
+
+//set hub broker address, example: tcp://127.0.0.1:1883, ssl://127.0.0.1:8883 or mqtts://127.0.0.1:8883
+func SetHubAddress(address string) SessionOption {
+	return newFuncSessionOption(func(i *sessionOptions) {
+		i.hubAddress = address
+	})
+}
+
+//set metadata service address, example: http://127.0.0.1:9611
+func SetMetadataAddress(address string) SessionOption {
+	return newFuncSessionOption(func(i *sessionOptions) {
+		i.metadataAddress = address
+	})
+}
+
+//set session logger
+func SetSessionLogger(logger Logger) SessionOption {
+	return newFuncSessionOption(func(i *sessionOptions) {
+		i.logger = logger
+	})
+}
+
+//set hub connect retry backoff, zero fields use default backoff and multiplier is at least 1
+func SetConnectBackoff(backoff Backoff) SessionOption {
+	return newFuncSessionOption(func(i *sessionOptions) {
+		i.backoff = backoff
+	})
+}
+
+//enable offline queue, property and event reports are buffered while hub is not connected
+//and replayed in order after reconnect
+func SetOfflineQueue(opts QueueOptions) SessionOption {
+	return newFuncSessionOption(func(i *sessionOptions) {
+		i.queue = &opts
+	})
+}
+
+//set thing model cache ttl, default 5 minutes. cached models are also expired by
+//subDeviceChanged and edgeConfigChanged notifications, 0 fetches model on every report
+func SetModelCacheTTL(ttl time.Duration) SessionOption {
+	return newFuncSessionOption(func(i *sessionOptions) {
+		i.modelTTL = ttl
+	})
+}
+
+//run sub device service calls on worker pool instead of mqtt message callback,
+//calls of the same device keep their order
+func SetDispatcher(opts DispatcherOptions) SessionOption {
+	return newFuncSessionOption(func(i *sessionOptions) {
+		i.dispatcher = &opts
+	})
+}
+
+//set mqtt qos (0, 1 or 2) of message class
+func SetQoS(class MessageClass, qos byte) SessionOption {
+	return newFuncSessionOption(func(i *sessionOptions) {
+		if class >= 0 && class < messageClassCount {
+			i.policies[class].qos = qos
+		}
+	})
+}
+
+//set mqtt retain flag of message class, device status is retained by default
+func SetRetained(class MessageClass, retained bool) SessionOption {
+	return newFuncSessionOption(func(i *sessionOptions) {
+		if class >= 0 && class < messageClassCount {
+			i.policies[class].retained = retained
+		}
+	})
+}
+
+//enable driver status report, the driver status topic is used as mqtt will,
+//so the platform learns that all sub devices of driver are offline when driver dies.
+//enabled by default
+func SetDriverWill(enable bool) SessionOption {
+	return newFuncSessionOption(func(i *sessionOptions) {
+		i.driverWill = enable
+	})
+}
+
+//set hub tls options, EDGE_HUB_TLS_CA, EDGE_HUB_TLS_CERT, EDGE_HUB_TLS_KEY
+//and EDGE_HUB_TLS_SERVER_NAME are used if not set
+func SetHubTLS(opts TLSOptions) SessionOption {
+	return newFuncSessionOption(func(i *sessionOptions) {
+		i.tlsOptions = opts
+	})
+}
+
+//set hub tls config
+func SetHubTLSConfig(config *tls.Config) SessionOption {
+	return newFuncSessionOption(func(i *sessionOptions) {
+		i.tlsConfig = config
+	})
+}
+
+//set hub credentials provider
+func SetHubCredentials(credentials CredentialsFunc) SessionOption {
+	return newFuncSessionOption(func(i *sessionOptions) {
+		i.credentials = credentials
+	})
+}
@@ -0,0 +1,245 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package edge_driver_go
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const queueFileExt = ".msg"
+
+type DropPolicy int
+
+const (
+	DropOldest DropPolicy = iota //drop the oldest queued message when queue is full
+	DropNewest                   //reject the new message when queue is full
+)
+
+//offline queue options
+type QueueOptions struct {
+	Dir         string        //queue directory, messages are only kept in memory if empty
+	MaxMessages int           //max queued messages, 0 is unlimited
+	MaxBytes    int64         //max queued payload bytes, 0 is unlimited
+	MaxAge      time.Duration //max message age, expired messages are dropped, 0 is unlimited
+	DropPolicy  DropPolicy    //drop policy when queue is full
+}
+
+//offline queue metrics
+type QueueStats struct {
+	Queued   int    //messages in queue
+	Bytes    int64  //payload bytes in queue
+	Enqueued uint64 //total queued messages
+	Replayed uint64 //total replayed messages
+	Dropped  uint64 //total messages dropped because queue is full
+	Expired  uint64 //total messages dropped because of max age
+	Rejected uint64 //total messages dropped because they are rejected on replay
+}
+
+type queueItem struct {
+	seq      uint64
+	Topic    string `json:"topic"`
+	Payload  []byte `json:"payload"`
+	Qos      byte   `json:"qos"`
+	Retained bool   `json:"retained"`
+	Time     int64  `json:"time"`
+}
+
+//bounded store-and-forward queue for reports published while hub is not connected
+type offlineQueue struct {
+	sync.Mutex
+	opts  QueueOptions
+	items []*queueItem
+	seq   uint64
+	stats QueueStats
+}
+
+func newOfflineQueue(opts QueueOptions) (*offlineQueue, error) {
+	q := &offlineQueue{
+		opts:  opts,
+		items: make([]*queueItem, 0),
+	}
+	if opts.Dir == "" {
+		return q, nil
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+//load queued messages left by last run
+func (q *offlineQueue) load() error {
+	files, err := ioutil.ReadDir(q.opts.Dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), queueFileExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), queueFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(q.opts.Dir, f.Name()))
+		if err != nil {
+			return err
+		}
+		item := &queueItem{}
+		if err = json.Unmarshal(content, item); err != nil {
+			//broken message, written when process crashed
+			os.Remove(filepath.Join(q.opts.Dir, f.Name()))
+			continue
+		}
+		item.seq = seq
+		q.items = append(q.items, item)
+		q.stats.Bytes += int64(len(item.Payload))
+		if seq > q.seq {
+			q.seq = seq
+		}
+	}
+	sort.Slice(q.items, func(i, j int) bool {
+		return q.items[i].seq < q.items[j].seq
+	})
+	return nil
+}
+
+func (q *offlineQueue) file(seq uint64) string {
+	return filepath.Join(q.opts.Dir, fmt.Sprintf("%020d%s", seq, queueFileExt))
+}
+
+func (q *offlineQueue) full(size int64) bool {
+	if q.opts.MaxMessages > 0 && len(q.items)+1 > q.opts.MaxMessages {
+		return true
+	}
+	if q.opts.MaxBytes > 0 && q.stats.Bytes+size > q.opts.MaxBytes {
+		return true
+	}
+	return false
+}
+
+func (q *offlineQueue) push(topic string, payload []byte, policy publishPolicy) error {
+	q.Lock()
+	defer q.Unlock()
+	size := int64(len(payload))
+	if q.opts.MaxBytes > 0 && size > q.opts.MaxBytes {
+		q.stats.Dropped++
+		return ErrQueueFull
+	}
+	for q.full(size) {
+		if q.opts.DropPolicy == DropNewest || len(q.items) == 0 {
+			q.stats.Dropped++
+			return ErrQueueFull
+		}
+		q.remove()
+		q.stats.Dropped++
+	}
+	q.seq++
+	item := &queueItem{
+		seq:      q.seq,
+		Topic:    topic,
+		Payload:  payload,
+		Qos:      policy.qos,
+		Retained: policy.retained,
+		Time:     time.Now().UnixNano() / 1e6,
+	}
+	if q.opts.Dir != "" {
+		buf, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(q.file(item.seq), buf, 0644); err != nil {
+			return err
+		}
+	}
+	q.items = append(q.items, item)
+	q.stats.Bytes += size
+	q.stats.Enqueued++
+	return nil
+}
+
+//get the oldest message which is not expired
+func (q *offlineQueue) peek() *queueItem {
+	q.Lock()
+	defer q.Unlock()
+	for len(q.items) > 0 {
+		item := q.items[0]
+		if q.opts.MaxAge > 0 && time.Now().UnixNano()/1e6-item.Time > int64(q.opts.MaxAge/time.Millisecond) {
+			q.remove()
+			q.stats.Expired++
+			continue
+		}
+		return item
+	}
+	return nil
+}
+
+//remove replayed message
+func (q *offlineQueue) ack(item *queueItem) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.items) > 0 && q.items[0] == item {
+		q.remove()
+		q.stats.Replayed++
+	}
+}
+
+//drop replayed message rejected by mqtt client or broker
+func (q *offlineQueue) reject(item *queueItem) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.items) > 0 && q.items[0] == item {
+		q.remove()
+		q.stats.Rejected++
+	}
+}
+
+//remove the oldest message, lock must be held
+func (q *offlineQueue) remove() {
+	item := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	q.stats.Bytes -= int64(len(item.Payload))
+	if q.opts.Dir != "" {
+		os.Remove(q.file(item.seq))
+	}
+}
+
+func (q *offlineQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.items)
+}
+
+func (q *offlineQueue) getStats() QueueStats {
+	q.Lock()
+	defer q.Unlock()
+	stats := q.stats
+	stats.Queued = len(q.items)
+	return stats
+}
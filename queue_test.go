@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package edge_driver_go
+
+import (
+	"context"
+	"errors"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOfflineQueuePersistent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "edge-queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	q, err := newOfflineQueue(QueueOptions{Dir: dir})
+	assert.Nil(t, err)
+	assert.Nil(t, q.push("topic1", []byte("1"), publishPolicy{}))
+	assert.Nil(t, q.push("topic2", []byte("2"), publishPolicy{}))
+	//reopen queue
+	q, err = newOfflineQueue(QueueOptions{Dir: dir})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, q.len())
+	item := q.peek()
+	assert.Equal(t, "topic1", item.Topic)
+	q.ack(item)
+	assert.Nil(t, q.push("topic3", []byte("3"), publishPolicy{}))
+	item = q.peek()
+	assert.Equal(t, "topic2", item.Topic)
+	q.ack(item)
+	item = q.peek()
+	assert.Equal(t, "topic3", item.Topic)
+	q.ack(item)
+	assert.Nil(t, q.peek())
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(files))
+}
+func TestOfflineQueueDropPolicy(t *testing.T) {
+	q, err := newOfflineQueue(QueueOptions{MaxMessages: 2, DropPolicy: DropOldest})
+	assert.Nil(t, err)
+	assert.Nil(t, q.push("topic1", []byte("1"), publishPolicy{}))
+	assert.Nil(t, q.push("topic2", []byte("2"), publishPolicy{}))
+	assert.Nil(t, q.push("topic3", []byte("3"), publishPolicy{}))
+	assert.Equal(t, "topic2", q.peek().Topic)
+	assert.Equal(t, uint64(1), q.getStats().Dropped)
+
+	q, err = newOfflineQueue(QueueOptions{MaxBytes: 2, DropPolicy: DropNewest})
+	assert.Nil(t, err)
+	assert.Nil(t, q.push("topic1", []byte("1"), publishPolicy{}))
+	assert.Nil(t, q.push("topic2", []byte("2"), publishPolicy{}))
+	assert.Equal(t, ErrQueueFull, q.push("topic3", []byte("3"), publishPolicy{}))
+	assert.Equal(t, "topic1", q.peek().Topic)
+	stats := q.getStats()
+	assert.Equal(t, 2, stats.Queued)
+	assert.Equal(t, int64(2), stats.Bytes)
+	assert.Equal(t, uint64(1), stats.Dropped)
+}
+func TestOfflineQueueMaxAge(t *testing.T) {
+	q, err := newOfflineQueue(QueueOptions{MaxAge: 10 * time.Millisecond})
+	assert.Nil(t, err)
+	assert.Nil(t, q.push("topic1", []byte("1"), publishPolicy{}))
+	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, q.push("topic2", []byte("2"), publishPolicy{}))
+	assert.Equal(t, "topic2", q.peek().Topic)
+	assert.Equal(t, uint64(1), q.getStats().Expired)
+}
+
+func TestOfflineQueueRejected(t *testing.T) {
+	session := newTestSession(t, SetOfflineQueue(QueueOptions{}))
+	fake := connectFake(session)
+	policy := session.policy(PropertyMessage)
+
+	//rejected report is returned, not queued
+	fake.lock.Lock()
+	fake.publishErr = errors.New("not authorized")
+	fake.lock.Unlock()
+	err := session.report(context.Background(), "topic1", []byte("1"), policy)
+	assert.True(t, errors.Is(err, ErrPublishRejected))
+	assert.Equal(t, 0, session.QueueStats().Queued)
+
+	//report failed by lost connection is queued
+	fake.lock.Lock()
+	fake.publishErr = mqtt.ErrNotConnected
+	fake.lock.Unlock()
+	assert.Nil(t, session.report(context.Background(), "topic1", []byte("1"), policy))
+	assert.Nil(t, session.queue.push("topic2", []byte("2"), policy))
+
+	//rejected messages are dropped on replay and do not block the queue
+	fake.lock.Lock()
+	fake.publishErr = errors.New("not authorized")
+	fake.lock.Unlock()
+	for session.QueueStats().Queued > 0 {
+		session.replay()
+	}
+	stats := session.QueueStats()
+	assert.Equal(t, uint64(2), stats.Rejected)
+	assert.Equal(t, uint64(0), stats.Replayed)
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package edge_driver_go
+
+import (
+	"context"
+	"encoding/json"
+	uuid "github.com/satori/go.uuid"
+	"sync"
+	"time"
+)
+
+//delivery receipt of report, requested by WithReceipt
+type Receipt struct {
+	MessageIds []string  //ids of published messages, a report may be split into several messages. raw payload without id gets a generated id
+	AckedAt    time.Time //time the last message is acknowledged by broker, written to network for qos 0
+	Queued     bool      //some messages are kept in offline queue and delivered after reconnect
+	Unknown    bool      //delivery unknown, some messages are handed to mqtt client but not acknowledged before ctx is done, they may still be delivered
+}
+
+type receiptKey struct{}
+type deliveryKey struct{}
+
+//request delivery receipt of Report* call, the receipt is filled when the call returns, also when ctx is done
+func WithReceipt(ctx context.Context, receipt *Receipt) context.Context {
+	return context.WithValue(ctx, receiptKey{}, receipt)
+}
+
+//collect messages published by report goroutine, the receipt is only written by report caller
+type delivery struct {
+	lock     sync.Mutex
+	receipt  Receipt
+	inflight []string //ids of messages handed to mqtt client and not acknowledged yet
+	filled   bool     //no message is published after the receipt is filled
+	target   *Receipt
+}
+
+//bind delivery collector to ctx if receipt is requested
+func newDelivery(ctx context.Context) (context.Context, *delivery) {
+	target, _ := ctx.Value(receiptKey{}).(*Receipt)
+	if target == nil {
+		return ctx, nil
+	}
+	d := &delivery{target: target}
+	return context.WithValue(ctx, deliveryKey{}, d), d
+}
+
+func deliveryOf(ctx context.Context) *delivery {
+	d, _ := ctx.Value(deliveryKey{}).(*delivery)
+	return d
+}
+
+//id of message payload, an id is generated for raw payload without id, e.g. user message
+func messageId(payload []byte) string {
+	var msg struct {
+		Id string `json:"id"`
+	}
+	if err := json.Unmarshal(payload, &msg); err != nil || msg.Id == "" {
+		return uuid.NewV4().String()
+	}
+	return msg.Id
+}
+
+//record message about to be handed to mqtt client, false if the receipt is already filled
+func (d *delivery) sending(payload []byte) (string, bool) {
+	if d == nil {
+		return "", true
+	}
+	id := messageId(payload)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.filled {
+		return id, false
+	}
+	d.inflight = append(d.inflight, id)
+	return id, true
+}
+
+//remove message from inflight, acknowledged message is recorded
+func (d *delivery) sent(id string, acked bool) {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for i, v := range d.inflight {
+		if v == id {
+			d.inflight = append(d.inflight[:i], d.inflight[i+1:]...)
+			break
+		}
+	}
+	if acked {
+		d.receipt.MessageIds = append(d.receipt.MessageIds, id)
+		d.receipt.AckedAt = time.Now()
+	}
+}
+
+//record message kept in offline queue
+func (d *delivery) queued(payload []byte) {
+	if d == nil {
+		return
+	}
+	id := messageId(payload)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.receipt.MessageIds = append(d.receipt.MessageIds, id)
+	d.receipt.Queued = true
+}
+
+//copy collected delivery to receipt, messages not acknowledged yet are reported as delivery unknown
+func (d *delivery) fill() {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.filled = true
+	receipt := d.receipt
+	receipt.MessageIds = append(append([]string(nil), d.receipt.MessageIds...), d.inflight...)
+	receipt.Unknown = len(d.inflight) > 0
+	*d.target = receipt
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package edge_driver_go
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestReportReceipt(t *testing.T) {
+	client, fake, ctx, done := newTestClient(t)
+	defer done()
+
+	var receipt Receipt
+	assert.Nil(t, client.ReportProperties(WithReceipt(ctx, &receipt), Metadata{"temp": 20}))
+	var msg struct {
+		Id string `json:"id"`
+	}
+	assert.Nil(t, json.Unmarshal(fake.messages()[0].payload, &msg))
+	assert.Equal(t, []string{msg.Id}, receipt.MessageIds)
+	assert.False(t, receipt.AckedAt.IsZero())
+	assert.False(t, receipt.Queued)
+
+	fake.lock.Lock()
+	fake.publishErr = errors.New("not authorized")
+	fake.lock.Unlock()
+	err := client.ReportProperties(ctx, Metadata{"temp": 20})
+	assert.True(t, errors.Is(err, ErrPublishRejected))
+
+	fake.lock.Lock()
+	fake.publishErr, fake.pending = nil, true
+	fake.lock.Unlock()
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer timeoutCancel()
+	var unknown Receipt
+	assert.Equal(t, ErrPublishTimeout, client.ReportProperties(WithReceipt(timeoutCtx, &unknown), Metadata{"temp": 20}))
+	//message handed to mqtt client may still be delivered
+	assert.True(t, unknown.Unknown)
+	assert.Len(t, unknown.MessageIds, 1)
+	assert.True(t, unknown.AckedAt.IsZero())
+	published := len(fake.messages())
+	assert.Equal(t, ErrPublishTimeout, client.ReportProperties(timeoutCtx, Metadata{"temp": 20}))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, published, len(fake.messages()))
+}
+
+func TestReportReceiptQueued(t *testing.T) {
+	client, fake, ctx, done := newTestClient(t, testSessionOption{SetOfflineQueue(QueueOptions{})})
+	defer done()
+	fake.lock.Lock()
+	fake.publishErr = mqtt.ErrNotConnected
+	fake.lock.Unlock()
+
+	var receipt Receipt
+	assert.Nil(t, client.ReportEvent(WithReceipt(ctx, &receipt), "alarm", Metadata{"level": 1}))
+	assert.Len(t, receipt.MessageIds, 1)
+	assert.True(t, receipt.Queued)
+	assert.True(t, receipt.AckedAt.IsZero())
+}
+
+func TestReportReceiptRawPayload(t *testing.T) {
+	client, _, ctx, done := newTestClient(t)
+	defer done()
+
+	//raw payload has no message id, a unique id is generated for each message
+	var first, second Receipt
+	assert.Nil(t, client.ReportUserMessage(WithReceipt(ctx, &first), []byte("raw")))
+	assert.Nil(t, client.ReportUserMessage(WithReceipt(ctx, &second), []byte(`{"value":1}`)))
+	assert.Len(t, first.MessageIds, 1)
+	assert.Len(t, second.MessageIds, 1)
+	assert.NotEmpty(t, first.MessageIds[0])
+	assert.NotEmpty(t, second.MessageIds[0])
+	assert.NotEqual(t, first.MessageIds[0], second.MessageIds[0])
+	assert.False(t, first.AckedAt.IsZero())
+}
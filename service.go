@@ -0,0 +1,56 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package edge_driver_go
+
+import "sort"
+
+type serviceHandler struct {
+	call     OnEndServiceCallCtx
+	validate bool //validate args and reply data against thing model
+}
+
+//register handler of service, the handler replaces the previous one of the same name and
+//takes precedence over SetEndServiceCall. nil handler removes the service
+func (e *endClient) HandleService(name string, handler OnEndServiceCallCtx, validate bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if handler == nil {
+		delete(e.handlers, name)
+		return
+	}
+	e.handlers[name] = &serviceHandler{
+		call:     handler,
+		validate: validate,
+	}
+}
+
+//get registered service names in order
+func (e *endClient) Services() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	names := make([]string, 0, len(e.handlers))
+	for name := range e.handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (e *endClient) serviceHandler(name string) *serviceHandler {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.handlers[name]
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package edge_driver_go
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestHandleService(t *testing.T) {
+	var called []string
+	c, err := NewEndClient(newTestToken(t, testTokenKey, time.Time{}),
+		SetSession(newTestSession(t)),
+		SetEndServiceCall(func(name string, args Metadata) (*Reply, error) {
+			called = append(called, "default:"+name)
+			return &Reply{Code: RpcSuccess}, nil
+		}))
+	assert.Nil(t, err)
+	client, ok := c.(ClientEx)
+	assert.True(t, ok)
+	client.HandleService("reboot", func(ctx context.Context, req *ServiceRequest, args Metadata) (*Reply, error) {
+		called = append(called, "handler:"+req.Method)
+		return &Reply{Code: RpcSuccess}, nil
+	}, false)
+	client.HandleService("reset", func(ctx context.Context, req *ServiceRequest, args Metadata) (*Reply, error) {
+		return nil, nil
+	}, false)
+	assert.Equal(t, []string{"reboot", "reset"}, client.Services())
+	client.HandleService("reset", nil, false)
+	assert.Equal(t, []string{"reboot"}, client.Services())
+
+	e := client.(*endClient)
+	e.endCall(context.Background(), fmt.Sprintf(deviceService, "iott-test", "iotd-test", "reboot"), []byte(`{"id":"1","params":{}}`))
+	e.endCall(context.Background(), fmt.Sprintf(deviceService, "iott-test", "iotd-test", "reset"), []byte(`{"id":"2","params":{}}`))
+	assert.Equal(t, []string{"handler:reboot", "default:reset"}, called)
+}
+
+func TestUnknownService(t *testing.T) {
+	var called bool
+	client, fake, ctx, done := newTestClient(t, SetEndServiceCall(func(name string, args Metadata) (*Reply, error) {
+		called = true
+		return &Reply{Code: RpcSuccess}, nil
+	}))
+	defer done()
+
+	//service not defined in thing model is not passed to handler
+	topic := fmt.Sprintf(deviceService, "iott-test", "iotd-test", "shutdown")
+	client.(*endClient).endCall(ctx, topic, []byte(`{"id":"1","params":{}}`))
+	assert.False(t, called)
+	reply := fake.waitMessage(topic+"_reply", time.Second)
+	assert.NotNil(t, reply)
+	if reply != nil {
+		assert.JSONEq(t, fmt.Sprintf(`{"id":"1","code":%d,"data":{},"message":"unknown service: shutdown"}`, RpcUnsupported),
+			string(reply.payload))
+	}
+}
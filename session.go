@@ -17,6 +17,8 @@ package edge_driver_go
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -32,21 +34,25 @@ import (
 )
 
 var (
-	_ins  *session
-	_once sync.Once
+	_ins    *Session
+	_insErr error
+	_once   sync.Once
 )
 
-func getSessionIns() *session {
+//get default session, the session is created from environment variables on first use
+//and connects to hub in background
+func DefaultSession() (*Session, error) {
 	_once.Do(func() {
-		_ins = &session{
-			client:  nil,
-			status:  hubNotConnected,
-			logger:  newLogger(),
-			endList: make([]*endClient, 0),
+		_ins, _insErr = NewSession()
+		if _insErr == nil {
+			go func() {
+				if err := _ins.Connect(context.Background()); err != nil && _ins.logger != nil {
+					_ins.logger.Error("[sdk] connect hub failed:", err.Error())
+				}
+			}()
 		}
-		_ins.init()
 	})
-	return _ins
+	return _ins, _insErr
 }
 
 type desc struct {
@@ -55,34 +61,156 @@ type desc struct {
 }
 
 //module api
-type session struct {
-	client         mqtt.Client //hub client
-	metadataClient *http.Client
-	driverId       string
-	version        string
-	deviceId       string
-	thingId        string
-	endList []*endClient
-	status         uint32           //0:not connected, 1:connected
-	connectLost    ConnectLost      //connect lost callback
-	configChange   ConfigChangeFunc //config change
-	logger         Logger
-}
-
-func (s *session) init() {
-	var (
-		hubAddress string
-	)
-	if os.Getenv("EDGE_HUB_HOST") == "" || os.Getenv("EDGE_HUB_PORT") == "" {
-		hubAddress = hubBroker
-	} else {
-		hubAddress = fmt.Sprintf("tcp://%s:%s", os.Getenv("EDGE_HUB_HOST"), os.Getenv("EDGE_HUB_PORT"))
+type Session struct {
+	client          mqtt.Client //hub client
+	metadataClient  *http.Client
+	connecting      chan struct{} //held by the running Connect, waited with ctx
+	backoff         Backoff
+	hubAddress      string
+	metadataAddress string
+	driverId        string
+	clientId        string //hub client id
+	version         string
+	deviceId        string
+	thingId         string
+	endList         []*endClient
+	endLock         sync.RWMutex
+	queue           *offlineQueue //offline report queue, nil if not enabled
+	replaying       uint32
+	policies        [messageClassCount]publishPolicy //publish qos and retain of message class
+	driverWill      bool
+	tlsOptions      TLSOptions
+	tlsConfig       *tls.Config
+	credentials     CredentialsFunc
+	tokenKey        interface{} //parsed token verify key from metadata service
+	tokenKeyLock    sync.Mutex
+	models          *modelCache                     //thing model cache
+	dispatcher      *dispatcher                     //service call dispatcher, calls run in message callback if nil
+	edgeServices    map[string]OnEdgeServiceCallCtx //registered edge services
+	edgeLock        sync.Mutex
+	subscriptions   map[string]*subscription //subscriptions restored on reconnect
+	subLock         sync.Mutex
+	closed          chan struct{} //closed by Close
+	closeOnce       sync.Once
+	status          uint32           //0:not connected, 1:connected
+	connectLost     ConnectLost      //connect lost callback
+	reconnect       Reconnect        //called after connected and subscriptions restored
+	state           *stateObserver   //connection state
+	configChange    ConfigChangeFunc //config change
+	logger          Logger
+}
+
+//create session, unset options are read from environment variables.
+//the session does not connect to hub until Connect is called
+func NewSession(opt ...SessionOption) (*Session, error) {
+	opts := defaultSessionOptions
+	for _, o := range opt {
+		o.apply(&opts)
 	}
-	if s.driverId == "" {
-		if os.Getenv("EDGE_APP_ID") == "" {
-			panic(errors.New("driver id is not set,sdk can't run!"))
+	s := &Session{
+		client:          nil,
+		status:          hubNotConnected,
+		hubAddress:      opts.hubAddress,
+		metadataAddress: opts.metadataAddress,
+		driverId:        opts.driverId,
+		clientId:        opts.clientId,
+		deviceId:        opts.deviceId,
+		thingId:         opts.thingId,
+		logger:          opts.logger,
+		backoff:         opts.backoff,
+		policies:        opts.policies,
+		driverWill:      opts.driverWill,
+		tlsOptions:      opts.tlsOptions,
+		tlsConfig:       opts.tlsConfig,
+		credentials:     opts.credentials,
+		endList:         make([]*endClient, 0),
+		edgeServices:    make(map[string]OnEdgeServiceCallCtx),
+		subscriptions:   make(map[string]*subscription),
+		state:           newStateObserver(),
+		closed:          make(chan struct{}),
+		connecting:      make(chan struct{}, 1),
+	}
+	s.models = newModelCache(opts.modelTTL, s.fetchModel)
+	for _, p := range opts.policies {
+		if p.qos > 2 {
+			return nil, ErrInvalidQos
+		}
+	}
+	if opts.queue != nil {
+		queue, err := newOfflineQueue(*opts.queue)
+		if err != nil {
+			return nil, err
+		}
+		s.queue = queue
+	}
+	if opts.dispatcher != nil {
+		s.dispatcher = newDispatcher(*opts.dispatcher)
+	}
+	if err := s.init(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Session) init() error {
+	var err error
+	if s.tlsConfig == nil {
+		if !s.tlsOptions.enabled() {
+			s.tlsOptions = TLSOptions{
+				CAFile:     os.Getenv("EDGE_HUB_TLS_CA"),
+				CertFile:   os.Getenv("EDGE_HUB_TLS_CERT"),
+				KeyFile:    os.Getenv("EDGE_HUB_TLS_KEY"),
+				ServerName: os.Getenv("EDGE_HUB_TLS_SERVER_NAME"),
+			}
+		}
+		if s.tlsOptions.enabled() {
+			if s.tlsConfig, err = s.tlsOptions.config(); err != nil {
+				return err
+			}
+		}
+	}
+	if s.hubAddress == "" {
+		scheme, broker := "tcp", hubBroker
+		if s.tlsConfig != nil {
+			scheme, broker = "ssl", hubTLSBroker
+		}
+		if os.Getenv("EDGE_HUB_HOST") == "" || os.Getenv("EDGE_HUB_PORT") == "" {
+			s.hubAddress = broker
 		} else {
-			s.driverId = os.Getenv("EDGE_APP_ID")
+			s.hubAddress = fmt.Sprintf("%s://%s:%s", scheme, os.Getenv("EDGE_HUB_HOST"), os.Getenv("EDGE_HUB_PORT"))
+		}
+	}
+	s.hubAddress = normalizeBroker(s.hubAddress)
+	if s.metadataAddress == "" {
+		if val := os.Getenv("EDGE_META_ADDRESS"); val == "" {
+			s.metadataAddress = metadataBroker
+		} else {
+			s.metadataAddress = val
+		}
+	}
+	if s.driverId == "" {
+		s.driverId = os.Getenv("EDGE_APP_ID")
+	}
+	if s.driverId == "" {
+		return errors.New("driver id is not set,sdk can't run")
+	}
+	if s.deviceId == "" {
+		s.deviceId = os.Getenv("EDGE_DEVICE_ID")
+	}
+	if s.thingId == "" {
+		s.thingId = os.Getenv("EDGE_THING_ID")
+	}
+	if s.deviceId == "" || s.thingId == "" {
+		return errors.New("edge device id or thing id is not set")
+	}
+	if s.credentials == nil {
+		switch {
+		case os.Getenv("EDGE_HUB_PASSWORD_FILE") != "":
+			s.credentials = FileCredentials(os.Getenv("EDGE_HUB_USERNAME"), os.Getenv("EDGE_HUB_PASSWORD_FILE"))
+		case os.Getenv("EDGE_HUB_USERNAME") != "":
+			s.credentials = StaticCredentials(os.Getenv("EDGE_HUB_USERNAME"), os.Getenv("EDGE_HUB_PASSWORD"))
+		default:
+			s.credentials = StaticCredentials("edge.go."+s.driverId, "edge.go."+s.driverId)
 		}
 	}
 	s.metadataClient = &http.Client{
@@ -97,22 +225,26 @@ func (s *session) init() {
 			IdleConnTimeout:     time.Duration(IdleConnTimeout) * time.Second,
 		},
 	}
-	s.deviceId = os.Getenv("EDGE_DEVICE_ID")
-	s.thingId = os.Getenv("EDGE_THING_ID")
-	if s.deviceId == "" || s.thingId == "" {
-		panic("edge device id or thing id is not set!")
+	if s.clientId == "" {
+		s.clientId = fmt.Sprintf("edge.go.%s.%s", s.deviceId, s.driverId)
 	}
 	options := mqtt.NewClientOptions()
-	options.AddBroker(hubAddress).
-		SetClientID("edge.go." + s.driverId).
-		SetUsername("edge.go." + s.driverId).
-		SetPassword("edge.go." + s.driverId).
+	options.AddBroker(s.hubAddress).
+		SetClientID(s.clientId).
+		SetCredentialsProvider(func() (string, string) {
+			username, password, err := s.credentials()
+			if err != nil && s.logger != nil {
+				s.logger.Error("[sdk] get hub credentials failed:", err.Error())
+			}
+			return username, password
+		}).
 		SetCleanSession(true).
 		SetAutoReconnect(true).
 		SetKeepAlive(30 * time.Second).
 		SetConnectionLostHandler(func(client mqtt.Client, err error) {
 			//heartbeat lost
 			atomic.StoreUint32(&s.status, hubNotConnected)
+			s.state.set(StateReconnecting, err)
 			if s.connectLost != nil {
 				s.connectLost(err)
 			}
@@ -120,62 +252,121 @@ func (s *session) init() {
 				s.logger.Info("connect lost")
 			}
 		}).
-		SetOnConnectHandler(func(client mqtt.Client) {
-			atomic.StoreUint32(&s.status, hubConnected)
-			for _, e := range s.endList {
-				clientDeviceId := e.config.DeviceId()
-				clientThingId := e.config.ThingId()
-				var msg message
-				if isUserDevice(clientDeviceId) {
-					err := s.subscribe(msg.buildUserServiceTopic(clientDeviceId, clientThingId), e.userCall)
-					if err != nil {
-						if s.logger != nil {
-							s.logger.Warn(fmt.Sprintf("subscribe user service topic failed: %v", err))
-						}
-					}
-				} else {
-					//end service
-					err := getSessionIns().subscribe(msg.buildSetTopic(clientDeviceId, clientThingId), e.endCall)
-					if err != nil {
-						if s.logger != nil {
-							s.logger.Warn(fmt.Sprintf("subscribe set property topic failed: %v", err))
-						}
-					}
-					err = getSessionIns().subscribe(msg.buildGetTopic(clientDeviceId, clientThingId), e.getCall)
-					if err != nil {
-						if s.logger != nil {
-							s.logger.Warn(fmt.Sprintf("subscribe get property topic failed: %v", err))
-						}
-					}
-					err = getSessionIns().subscribe(fmt.Sprintf(deviceService, clientThingId, clientDeviceId, "+"), e.endCall)
-					if err != nil {
-						if s.logger != nil {
-							s.logger.Warn(fmt.Sprintf("subscribe device service topic failed: %v", err))
-						}
-					}
-				}
+		SetOnConnectHandler(s.onConnect)
+	if s.driverWill {
+		var msg message
+		policy := s.policy(StatusMessage)
+		options.SetBinaryWill(msg.buildDriverStatusTopic(s.deviceId, s.driverId),
+			msg.buildDriverStatusMsg(s.deviceId, s.thingId, s.driverId, offline, nil), policy.qos, true)
+	}
+	if s.tlsConfig != nil {
+		options.SetTLSConfig(s.tlsConfig)
+	}
+	s.client = mqtt.NewClient(options)
+	return nil
+}
+
+//restore subscriptions and status after hub is connected or reconnected
+func (s *Session) onConnect(client mqtt.Client) {
+	atomic.StoreUint32(&s.status, hubConnected)
+	for _, e := range s.endClients() {
+		if err := e.init(); err != nil && s.logger != nil {
+			s.logger.Warn(fmt.Sprintf("[sdk] subscribe service topics of %s failed: %v", e.config.DeviceId(), err))
+		}
+	}
+	for _, e := range s.endClients() {
+		e.restoreDeclaredStatus()
+	}
+	s.restoreSubscriptions()
+	client.Subscribe(fmt.Sprintf(configChange, s.driverId), s.policy(SubscribeMessage).qos, func(client mqtt.Client, i mqtt.Message) {
+		var msg message
+		t, err := msg.parseConfigType(i.Topic())
+		if err != nil {
+			if s.logger != nil {
+				s.logger.Warn("connect lost")
 			}
+			return
+		}
+		s.onConfigChange(t, i.Payload())
+	})
+	if s.driverWill {
+		if err := s.publishDriverStatus(online); err != nil && s.logger != nil {
+			s.logger.Warn("[sdk] publish driver status failed:", err.Error())
+		}
+	}
+	if s.queue != nil {
+		go s.replay()
+	}
+	s.state.set(StateConnected, nil)
+	if s.reconnect != nil {
+		s.reconnect()
+	}
+}
 
-			client.Subscribe(fmt.Sprintf(configChange, s.driverId), byte(0), func(client mqtt.Client, i mqtt.Message) {
-				var msg message
-				t, err := msg.parseConfigType(i.Topic())
-				if err != nil {
-					if s.logger != nil {
-						s.logger.Warn("connect lost")
-					}
-					return
-				}
-				if s.configChange != nil {
-					s.configChange(t, i.Payload())
-				}
-			})
-		})
-	client := mqtt.NewClient(options)
-	s.connect(hubAddress, client) //reconnected
-	s.client = client
+//connect hub, retry with exponential backoff until connected, ctx done or max attempts reached.
+//a running Connect is waited until ctx is done
+func (s *Session) Connect(ctx context.Context) error {
+	var err error
+	select {
+	case s.connecting <- struct{}{}:
+	case <-ctx.Done():
+		return &ConnectError{Address: s.hubAddress, Err: ctx.Err()}
+	}
+	defer func() {
+		<-s.connecting
+	}()
+	if s.client.IsConnected() {
+		return nil
+	}
+	s.state.set(StateConnecting, nil)
+	err = s.connect(ctx)
+	if err != nil {
+		s.state.set(StateDisconnected, err)
+	}
+	return err
 }
 
-func (s *session) contains(l []*endClient, e *endClient) bool {
+//connect with backoff until connected, ctx done or max attempts
+func (s *Session) connect(ctx context.Context) error {
+	var (
+		attempt int
+		err     error
+	)
+	for {
+		select {
+		case <-s.closed:
+			return &ConnectError{Address: s.hubAddress, Attempts: attempt, Err: ErrSessionClosed}
+		default:
+		}
+		attempt++
+		if err = waitToken(ctx, s.client.Connect()); err == nil {
+			//connected state is set by onConnect after subscriptions are restored
+			atomic.StoreUint32(&s.status, hubConnected)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return &ConnectError{Address: s.hubAddress, Attempts: attempt, Err: err}
+		}
+		if s.backoff.MaxAttempts > 0 && attempt >= s.backoff.MaxAttempts {
+			return &ConnectError{Address: s.hubAddress, Attempts: attempt, Err: err}
+		}
+		if s.logger != nil {
+			s.logger.Info("[sdk] connect retry...,", s.hubAddress, err.Error())
+		}
+		timer := time.NewTimer(s.backoff.next(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return &ConnectError{Address: s.hubAddress, Attempts: attempt, Err: ctx.Err()}
+		case <-s.closed:
+			timer.Stop()
+			return &ConnectError{Address: s.hubAddress, Attempts: attempt, Err: ErrSessionClosed}
+		}
+	}
+}
+
+func (s *Session) contains(l []*endClient, e *endClient) bool {
 	for _, a := range l {
 		if a == e {
 			return true
@@ -184,15 +375,103 @@ func (s *session) contains(l []*endClient, e *endClient) bool {
 	return false
 }
 
-func (s *session) registerEndClient(e *endClient) error {
-	if ! s.contains(s.endList, e) {
-		s.endList = append(s.endList, e)
-		s.logger.Info("[sdk] register end device,", e.config.DeviceId(), e.config.ThingId())
+func (s *Session) registerEndClient(e *endClient) error {
+	s.endLock.Lock()
+	if s.contains(s.endList, e) {
+		s.endLock.Unlock()
+		return nil
+	}
+	s.endList = append(s.endList, e)
+	s.endLock.Unlock()
+	s.logger.Info("[sdk] register end device,", e.config.DeviceId(), e.config.ThingId())
+	if s.driverWill {
+		return s.publishDriverStatus(online)
+	}
+	return nil
+}
+
+//remove end client, it is not resubscribed on reconnect
+func (s *Session) unregisterEndClient(e *endClient) error {
+	s.endLock.Lock()
+	found := false
+	for i, v := range s.endList {
+		if v == e {
+			s.endList = append(s.endList[:i], s.endList[i+1:]...)
+			found = true
+			break
+		}
+	}
+	s.endLock.Unlock()
+	if !found {
+		return nil
+	}
+	s.logger.Info("[sdk] unregister end device,", e.config.DeviceId(), e.config.ThingId())
+	select {
+	case <-s.closed:
+		//offline driver status with all devices is published by Close
+		return nil
+	default:
+	}
+	if s.driverWill && atomic.LoadUint32(&s.status) == hubConnected {
+		return s.publishDriverStatus(online)
 	}
 	return nil
 }
 
-func (s *session) getDriverVersion() string {
+//handle config change notification
+func (s *Session) onConfigChange(t string, payload []byte) {
+	if t == SubDeviceChanged || t == EdgeConfigChanged {
+		s.models.invalidate()
+	}
+	if t == SubDeviceChanged {
+		for _, e := range s.endClients() {
+			go e.refreshToken()
+		}
+	}
+	if s.configChange != nil {
+		s.configChange(t, payload)
+	}
+}
+
+//run service call on dispatcher, or in message callback if dispatcher is not set.
+//false if dispatcher is full
+func (s *Session) dispatch(key string, call dispatchCall) bool {
+	if s.dispatcher == nil {
+		call(context.Background())
+		return true
+	}
+	return s.dispatcher.dispatch(key, call)
+}
+
+//get registered end clients
+func (s *Session) endClients() []*endClient {
+	s.endLock.RLock()
+	defer s.endLock.RUnlock()
+	return append([]*endClient(nil), s.endList...)
+}
+
+//publish retained driver status with registered sub devices.
+//sub devices are also kept on devices topic, because the will message overwrites the status without devices
+func (s *Session) publishDriverStatus(status string) error {
+	var msg message
+	devices := make([]*driverDevice, 0)
+	for _, e := range s.endClients() {
+		devices = append(devices, &driverDevice{
+			DeviceId: e.config.DeviceId(),
+			ThingId:  e.config.ThingId(),
+		})
+	}
+	policy := s.policy(StatusMessage)
+	policy.retained = true
+	if err := s.publish(msg.buildDriverDevicesTopic(s.deviceId, s.driverId),
+		msg.buildDriverDevicesMsg(s.deviceId, s.thingId, s.driverId, devices), policy); err != nil {
+		return err
+	}
+	return s.publish(msg.buildDriverStatusTopic(s.deviceId, s.driverId),
+		msg.buildDriverStatusMsg(s.deviceId, s.thingId, s.driverId, status, devices), policy)
+}
+
+func (s *Session) getDriverVersion() string {
 	if s.version == "" {
 		resp, err := s.getDriverInfo()
 		if err != nil {
@@ -206,99 +485,250 @@ func (s *session) getDriverVersion() string {
 	}
 }
 
-func (s *session) getDriverId() string {
+func (s *Session) getDriverId() string {
 	return s.driverId
 }
 
-func (s *session) getDeviceId() string {
+func (s *Session) getDeviceId() string {
 	return s.deviceId
 }
 
-func (s *session) getThingId() string {
+func (s *Session) getThingId() string {
 	return s.thingId
 }
 
-func (s *session) connect(address string, client mqtt.Client) {
-	for {
-		if token := client.Connect(); token.Wait() && token.Error() != nil {
-			if s.logger != nil {
-				s.logger.Info("[sdk] connect retry...,", address, token.Error().Error())
-			}
-			time.Sleep(3 * time.Second)
-			continue
-		} else {
-			atomic.StoreUint32(&s.status, hubConnected)
-
-			return
-		}
-	}
-}
-func (s *session) subscribe(topic string, call messageArrived) error {
+func (s *Session) subscribe(topic string, qos byte, call messageArrived) error {
 	s.logger.Info("[sdk] subscribe topic:", topic)
 	if atomic.LoadUint32(&s.status) == 0 {
-		return notConnected
+		return ErrNotConnected
 	}
-	token := s.client.Subscribe(topic, byte(0), func(client mqtt.Client, message mqtt.Message) {
+	token := s.client.Subscribe(topic, qos, func(client mqtt.Client, message mqtt.Message) {
 		call(message.Topic(), message.Payload())
 	})
 	if token.Wait() && token.Error() != nil {
-		return token.Error()
+		return fmt.Errorf("subscribe %s: %w", topic, token.Error())
 	}
 	return nil
 }
-func (s *session) subscribes(topics []string, call messageArrived) error {
+func (s *Session) subscribes(topics []string, qos byte, call messageArrived) error {
 	if atomic.LoadUint32(&s.status) == 0 {
-		return notConnected
+		return ErrNotConnected
 	}
 	filters := make(map[string]byte)
 	for _, v := range topics {
-		filters[v] = byte(0)
+		filters[v] = qos
 	}
 	token := s.client.SubscribeMultiple(filters, func(client mqtt.Client, message mqtt.Message) {
 		call(message.Topic(), message.Payload())
 	})
 	if token.Wait() && token.Error() != nil {
-		return token.Error()
+		return fmt.Errorf("subscribe %s: %w", strings.Join(topics, ","), token.Error())
 	}
 	return nil
 }
-func (s *session) setConnectLost(connectLost ConnectLost) {
+
+func (s *Session) unsubscribe(topics ...string) error {
+	if atomic.LoadUint32(&s.status) == 0 {
+		return ErrNotConnected
+	}
+	token := s.client.Unsubscribe(topics...)
+	if token.Wait() && token.Error() != nil {
+		return fmt.Errorf("unsubscribe %s: %w", strings.Join(topics, ","), token.Error())
+	}
+	return nil
+}
+
+//subscribe topic and keep it, kept subscriptions are restored on reconnect.
+//the topic is subscribed on connect if hub is not connected
+func (s *Session) subscribeKeep(topic string, qos byte, call messageArrived) error {
+	s.subLock.Lock()
+	s.subscriptions[topic] = &subscription{qos: qos, call: call}
+	s.subLock.Unlock()
+	err := s.subscribe(topic, qos, call)
+	if errors.Is(err, ErrNotConnected) {
+		return nil
+	}
+	if err != nil {
+		s.subLock.Lock()
+		delete(s.subscriptions, topic)
+		s.subLock.Unlock()
+	}
+	return err
+}
+
+//unsubscribe kept topics
+func (s *Session) unsubscribeKeep(topics ...string) error {
+	s.subLock.Lock()
+	for _, topic := range topics {
+		delete(s.subscriptions, topic)
+	}
+	s.subLock.Unlock()
+	err := s.unsubscribe(topics...)
+	if errors.Is(err, ErrNotConnected) {
+		return nil
+	}
+	return err
+}
+
+//subscribe kept topics again, clean session drops subscriptions on reconnect
+func (s *Session) restoreSubscriptions() {
+	s.subLock.Lock()
+	subscriptions := make(map[string]*subscription, len(s.subscriptions))
+	for topic, sub := range s.subscriptions {
+		subscriptions[topic] = sub
+	}
+	s.subLock.Unlock()
+	for topic, sub := range subscriptions {
+		if err := s.subscribe(topic, sub.qos, sub.call); err != nil && s.logger != nil {
+			s.logger.Warn("[sdk] restore subscription failed:", topic, err.Error())
+		}
+	}
+}
+
+//subscribe topic, the subscription is restored on reconnect until Unsubscribe
+func (s *Session) Subscribe(topic string, qos byte, call func(topic string, payload []byte)) error {
+	if qos > 2 {
+		return ErrInvalidQos
+	}
+	return s.subscribeKeep(topic, qos, call)
+}
+
+//unsubscribe topic subscribed by Subscribe
+func (s *Session) Unsubscribe(topic string) error {
+	return s.unsubscribeKeep(topic)
+}
+
+//set reconnect call, called after every connect when subscriptions are restored
+func (s *Session) SetReconnect(reconnect Reconnect) {
+	s.reconnect = reconnect
+}
+
+//set lost call
+func (s *Session) SetConnectLost(connectLost ConnectLost) {
 	s.connectLost = connectLost
 }
-func (s *session) setConfigChange(configChange ConfigChangeFunc) {
+
+//set config change call
+func (s *Session) SetConfigChange(configChange ConfigChangeFunc) {
 	s.configChange = configChange
 }
 
-func (s *session) publish(topic string, payload []byte) error {
+//get session publish policy of message class
+func (s *Session) policy(class MessageClass) publishPolicy {
+	return s.policies[class]
+}
+
+func (s *Session) publish(topic string, payload []byte, policy publishPolicy) error {
+	return s.publishCtx(context.Background(), topic, payload, policy)
+}
+
+//publish and wait for ack until ctx is done, the message is not published if ctx is already done
+func (s *Session) publishCtx(ctx context.Context, topic string, payload []byte, policy publishPolicy) error {
+	if ctx.Err() != nil {
+		return ErrPublishTimeout
+	}
 	if atomic.LoadUint32(&s.status) == 0 {
-		return notConnected
+		return ErrNotConnected
+	}
+	receipt := deliveryOf(ctx)
+	id, ok := receipt.sending(payload)
+	if !ok {
+		return ErrPublishTimeout
+	}
+	token := s.client.Publish(topic, policy.qos, policy.retained, payload)
+	for !token.WaitTimeout(tokenPollInterval) {
+		if ctx.Err() != nil {
+			//the message can't be cancelled, it stays inflight and the receipt reports delivery unknown
+			return ErrPublishTimeout
+		}
+	}
+	if err := token.Error(); err != nil {
+		receipt.sent(id, false)
+		if err == mqtt.ErrNotConnected {
+			return fmt.Errorf("%w: %v", ErrNotConnected, err)
+		}
+		return fmt.Errorf("%w: %v", ErrPublishRejected, err)
+	}
+	receipt.sent(id, true)
+	return nil
+}
+
+//publish report, reports are kept in offline queue while hub is not connected.
+//report timed out by ctx or rejected is not queued, timed out report may still be delivered by mqtt client
+func (s *Session) report(ctx context.Context, topic string, payload []byte, policy publishPolicy) error {
+	if s.queue == nil {
+		return s.publishCtx(ctx, topic, payload, policy)
+	}
+	if atomic.LoadUint32(&s.status) == hubConnected && s.queue.len() == 0 {
+		err := s.publishCtx(ctx, topic, payload, policy)
+		if !errors.Is(err, ErrNotConnected) {
+			return err
+		}
+	}
+	if err := s.queue.push(topic, payload, policy); err != nil {
+		if s.logger != nil {
+			s.logger.Warn("[sdk] offline queue drop message:", topic, err.Error())
+		}
+		return err
 	}
-	if token := s.client.Publish(topic, byte(0), false, payload); token.Wait() && token.Error() != nil {
-		return token.Error()
+	deliveryOf(ctx).queued(payload)
+	if atomic.LoadUint32(&s.status) == hubConnected {
+		go s.replay()
 	}
 	return nil
 }
-func (s *session) getEdgeInfo() (*edgeDevInfo, error) {
+
+//replay offline queue in order, stop when hub is not connected.
+//rejected message is dropped, so it does not block the messages after it
+func (s *Session) replay() {
+	for atomic.CompareAndSwapUint32(&s.replaying, 0, 1) {
+		for {
+			item := s.queue.peek()
+			if item == nil {
+				break
+			}
+			if err := s.publish(item.Topic, item.Payload, publishPolicy{qos: item.Qos, retained: item.Retained}); err != nil {
+				if errors.Is(err, ErrPublishRejected) {
+					if s.logger != nil {
+						s.logger.Warn("[sdk] offline queue drop rejected message:", item.Topic, err.Error())
+					}
+					s.queue.reject(item)
+					continue
+				}
+				if s.logger != nil {
+					s.logger.Warn("[sdk] offline queue replay failed:", err.Error())
+				}
+				atomic.StoreUint32(&s.replaying, 0)
+				return
+			}
+			s.queue.ack(item)
+		}
+		atomic.StoreUint32(&s.replaying, 0)
+		//message may be queued after the last peek
+		if s.queue.len() == 0 {
+			return
+		}
+	}
+}
+
+//get offline queue metrics
+func (s *Session) QueueStats() QueueStats {
+	if s.queue == nil {
+		return QueueStats{}
+	}
+	return s.queue.getStats()
+}
+func (s *Session) getEdgeInfo() (*edgeDevInfo, error) {
 	var (
 		err      error
-		resp     *http.Response
 		content  []byte
 		response *edgeDevInfo
 		result   map[string]string
 		request  string
 	)
 	response = &edgeDevInfo{}
-	if val := os.Getenv("EDGE_META_ADDRESS"); val == "" {
-		request = fmt.Sprintf(edgeInfoRequest, metadataBroker)
-	} else {
-		request = fmt.Sprintf(edgeInfoRequest, val)
-	}
-	resp, err = s.metadataClient.Get(request)
-	if err != nil {
-		return response, err
-	}
-	defer resp.Body.Close()
-	content, err = ioutil.ReadAll(resp.Body)
+	request = fmt.Sprintf(edgeInfoRequest, s.metadataAddress)
+	content, err = s.metadataGet(request)
 	if err != nil {
 		s.logger.Error("[sdk] getEdgeInfo err:", err.Error(), string(content))
 		return response, err
@@ -306,7 +736,7 @@ func (s *session) getEdgeInfo() (*edgeDevInfo, error) {
 	err = json.Unmarshal(content, &result)
 	if err != nil {
 		s.logger.Error(string(content))
-		return response, err
+		return response, &MetadataError{Url: request, StatusCode: http.StatusOK, Err: err}
 	}
 	for k, v := range result {
 		switch {
@@ -321,10 +751,9 @@ func (s *session) getEdgeInfo() (*edgeDevInfo, error) {
 	}
 	return response, err
 }
-func (s *session) getConfig() ([]*SubDeviceInfo, error) {
+func (s *Session) getConfig() ([]*SubDeviceInfo, error) {
 	var (
 		err      error
-		resp     *http.Response
 		content  []byte
 		result   driverResult
 		response []*SubDeviceInfo
@@ -333,24 +762,15 @@ func (s *session) getConfig() ([]*SubDeviceInfo, error) {
 		request string
 	)
 	//temp = make(map[string]string)
-	if val := os.Getenv("EDGE_META_ADDRESS"); val == "" {
-		request = fmt.Sprintf(edgeDriverRequest, metadataBroker)
-	} else {
-		request = fmt.Sprintf(edgeDriverRequest, val)
-	}
-	resp, err = s.metadataClient.Get(request + s.driverId)
-	if err != nil {
-		return response, err
-	}
-	defer resp.Body.Close()
-	content, err = ioutil.ReadAll(resp.Body)
+	request = fmt.Sprintf(edgeDriverRequest, s.metadataAddress) + s.driverId
+	content, err = s.metadataGet(request)
 	if err != nil {
 		return response, err
 	}
 	//s.logger.Info(string(content))
 	if err = json.Unmarshal(content, &result); err != nil {
 		s.logger.Error("[sdk] getConfig Unmarshal:", err.Error())
-		return response, err
+		return response, &MetadataError{Url: request, StatusCode: http.StatusOK, Err: err}
 	}
 	for _, v := range result.Channels {
 		temp, err = s.getSubDevice(v.SubDeviceId)
@@ -393,36 +813,24 @@ func (s *session) getConfig() ([]*SubDeviceInfo, error) {
 	}
 	return response, err
 }
-func (s *session) getSubDevice(id string) (*device, error) {
+func (s *Session) getSubDevice(id string) (*device, error) {
 	var (
 		err      error
-		resp     *http.Response
 		content  []byte
 		response *device
 		request  string
 	)
 	response = &device{}
-	if val := os.Getenv("EDGE_META_ADDRESS"); val == "" {
-		// request = fmt.Sprintf("%s/test/data/childDevice/", metadataBroker)
-		request = fmt.Sprintf(subDeviceRequest, metadataBroker)
-	} else {
-		// request = fmt.Sprintf("%s/test/data/childDevice/", val)
-		request = fmt.Sprintf(subDeviceRequest, val)
-	}
+	request = fmt.Sprintf(subDeviceRequest, s.metadataAddress) + id
 	// resp, err = s.metadataClient.Get(request + id + "/get")
-	resp, err = s.metadataClient.Get(request + id)
-	if err != nil {
-		return response, err
-	}
-	defer resp.Body.Close()
-	content, err = ioutil.ReadAll(resp.Body)
+	content, err = s.metadataDevice(request)
 	if err != nil {
 		return response, err
 	}
 	// 单值情况
 	err = json.Unmarshal(content, response)
 	if err != nil {
-		return nil, err
+		return nil, &MetadataError{Url: request, StatusCode: http.StatusOK, Err: err}
 	}
 	if response.TokenContent != "" {
 		return response, err
@@ -432,13 +840,13 @@ func (s *session) getSubDevice(id string) (*device, error) {
 	kv := make(map[string]string)
 	err = json.Unmarshal(content, &kv)
 	if err != nil {
-		return nil, err
+		return nil, &MetadataError{Url: request, StatusCode: http.StatusOK, Err: err}
 	}
 	for _, v := range kv {
 		d := &device{}
 		err = json.Unmarshal([]byte(v), d)
 		if err != nil {
-			return nil, err
+			return nil, &MetadataError{Url: request, StatusCode: http.StatusOK, Err: err}
 		}
 		if d.DeviceId == id {
 			return d, nil
@@ -446,104 +854,64 @@ func (s *session) getSubDevice(id string) (*device, error) {
 	}
 	return response, err
 }
-func (s *session) getModel(id string) (*ThingModel, error) {
-	var (
-		err      error
-		resp     *http.Response
-		content  []byte
-		response *ThingModel
-		temp     device
-		request  string
-	)
-	response = &ThingModel{
-		Properties: make(map[string]*Property, 0),
+
+//get device thing model from cache, the last known model is used when metadata service is unavailable
+func (s *Session) getModel(id string) (*ThingModel, error) {
+	model, stale, err := s.models.get(id)
+	if stale && s.logger != nil {
+		s.logger.Warn("[sdk] get thing model failed, use last known model:", id, err.Error())
 	}
-	if val := os.Getenv("EDGE_META_ADDRESS"); val == "" {
-		request = fmt.Sprintf(subDeviceRequest, metadataBroker)
-	} else {
-		request = fmt.Sprintf(subDeviceRequest, val)
+	if stale {
+		return model, nil
 	}
-	resp, err = s.metadataClient.Get(request + id)
-	if err != nil {
-		return response, err
-	}
-	defer resp.Body.Close()
-	content, err = ioutil.ReadAll(resp.Body)
+	return model, err
+}
+
+//fetch device thing model from metadata service
+func (s *Session) fetchModel(id string) (*ThingModel, error) {
+	var (
+		err     error
+		content []byte
+		temp    device
+		request string
+	)
+	request = fmt.Sprintf(subDeviceRequest, s.metadataAddress) + id
+	content, err = s.metadataDevice(request)
 	if err != nil {
-		return response, err
+		return newThingModel(), err
 	}
 	//s.logger.Info(string(content))
 	//todo need fix
 	err = json.Unmarshal(content, &temp)
 	if err != nil {
 		s.logger.Error("json unmarshal error", string(content))
-		return response, err
+		return newThingModel(), &MetadataError{Url: request, StatusCode: http.StatusOK, Err: err}
 	}
 
 	if temp.TokenContent != "" {
 		// 单值情况
-		for _, v := range temp.Properties {
-			p := &Property{
-				Name:       v.Name,
-				Identifier: v.Identifier,
-				Type:       DefineType(v.Type).String(),
-				Define:     make(map[string]interface{}),
-				Ext:        make(map[string]interface{}),
-			}
-			if v.Define != nil {
-				if err = json.Unmarshal(v.Define, &p.Define); err != nil {
-					continue
-				}
-			}
-			if v.Ext != nil {
-				if err = json.Unmarshal(v.Ext, &p.Ext); err != nil {
-					continue
-				}
-			}
-			response.Properties[v.Identifier] = p
-		}
-		return response, err
+		return temp.thingModel(), nil
 	} else {
 		// 多值情况
 		kv := make(map[string]string)
 		err = json.Unmarshal(content, &kv)
 		if err != nil {
-			return nil, err
+			return nil, &MetadataError{Url: request, StatusCode: http.StatusOK, Err: err}
 		}
 		for _, v := range kv {
 			d := &device{}
 			err = json.Unmarshal([]byte(v), d)
 			if err != nil {
-				return nil, err
+				return nil, &MetadataError{Url: request, StatusCode: http.StatusOK, Err: err}
 			}
 			if d.DeviceId == id {
-				for _, v := range d.Properties {
-					p := &Property{
-						Name:       v.Name,
-						Identifier: v.Identifier,
-						Type:       DefineType(v.Type).String(),
-						Define:     make(map[string]interface{}),
-						Ext:        make(map[string]interface{}),
-					}
-					if v.Define != nil {
-						if err = json.Unmarshal(v.Define, &p.Define); err != nil {
-							continue
-						}
-					}
-					if v.Ext != nil {
-						if err = json.Unmarshal(v.Ext, &p.Ext); err != nil {
-							continue
-						}
-					}
-					response.Properties[v.Identifier] = p
-				}
-				return response, err
+				return d.thingModel(), nil
 			}
 		}
 	}
-	return nil, errors.New("no ssuch thing model")
+	return nil, fmt.Errorf("%w: %s", ErrModelNotFound, id)
 }
-func (s *session) getDriver() (string, error) {
+func (s *Session) getDriver() (string, error) {
 	resp, err := s.getDriverInfo()
 	if err != nil {
 		return "", err
@@ -551,26 +919,16 @@ func (s *session) getDriver() (string, error) {
 		return resp.DriverCfg, nil
 	}
 }
-func (s *session) getDriverInfo() (*driverResult, error) {
+func (s *Session) getDriverInfo() (*driverResult, error) {
 	var (
 		err     error
-		resp    *http.Response
 		content []byte
 		result  *driverResult
 		request string
 	)
 	//response = Metadata{}
-	if val := os.Getenv("EDGE_META_ADDRESS"); val == "" {
-		request = fmt.Sprintf(edgeDriverRequest, metadataBroker)
-	} else {
-		request = fmt.Sprintf(edgeDriverRequest, val)
-	}
-	resp, err = s.metadataClient.Get(request + s.driverId)
-	if err != nil {
-		return result, err
-	}
-	defer resp.Body.Close()
-	content, err = ioutil.ReadAll(resp.Body)
+	request = fmt.Sprintf(edgeDriverRequest, s.metadataAddress) + s.driverId
+	content, err = s.metadataGet(request)
 	if err != nil {
 		return result, err
 	}
@@ -578,59 +936,140 @@ func (s *session) getDriverInfo() (*driverResult, error) {
 	err = json.Unmarshal(content, result)
 	if err != nil {
 		s.logger.Error("[sdk] getDriver:", string(content), err.Error())
-		return result, err
+		return result, &MetadataError{Url: request, StatusCode: http.StatusOK, Err: err}
 	}
 	return result, nil
 }
 
+//get token verify key from metadata service, the key is parsed and cached after first success
+func (s *Session) getTokenKey() (interface{}, error) {
+	var (
+		err     error
+		content []byte
+		request string
+	)
+	s.tokenKeyLock.Lock()
+	defer s.tokenKeyLock.Unlock()
+	if s.tokenKey != nil {
+		return s.tokenKey, nil
+	}
+	request = fmt.Sprintf(tokenKeyRequest, s.metadataAddress) + s.driverId
+	content, err = s.metadataGet(request)
+	if err != nil {
+		return nil, err
+	}
+	if len(content) == 0 {
+		return nil, &MetadataError{Url: request, StatusCode: http.StatusOK, Err: errors.New("empty token key")}
+	}
+	if s.tokenKey, err = parseTokenKey(content); err != nil {
+		return nil, &MetadataError{Url: request, StatusCode: http.StatusOK, Err: err}
+	}
+	return s.tokenKey, nil
+}
+
 // support json
-func (s *session) setValue(key string, value []byte) error {
+func (s *Session) setValue(key string, value []byte) error {
 	var (
 		err     error
 		resp    *http.Response
 		request string
 	)
-	if val := os.Getenv("EDGE_META_ADDRESS"); val == "" {
-		request = fmt.Sprintf(storeRequest, metadataBroker)
-	} else {
-		request = fmt.Sprintf(storeRequest, val)
-	}
+	request = fmt.Sprintf(storeRequest, s.metadataAddress) + key
 	//response = Metadata{}
-	resp, err = s.metadataClient.Post(request+key, "application/json", bytes.NewBuffer(value))
+	resp, err = s.metadataClient.Post(request, "application/json", bytes.NewBuffer(value))
 	if err != nil {
-		return err
+		return &MetadataError{Url: request, Err: err}
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return &MetadataError{Url: request, StatusCode: resp.StatusCode}
+	}
 	return nil
 }
-func (s *session) getValue(key string) ([]byte, error) {
+func (s *Session) getValue(key string) ([]byte, error) {
 	var (
 		err     error
-		resp    *http.Response
 		request string
 		content []byte
 	)
 	//response = Metadata{}
-	if val := os.Getenv("EDGE_META_ADDRESS"); val == "" {
-		request = fmt.Sprintf(storeRequest, metadataBroker)
-	} else {
-		request = fmt.Sprintf(storeRequest, val)
-	}
-	resp, err = s.metadataClient.Get(request + key)
+	request = fmt.Sprintf(storeRequest, s.metadataAddress) + key
+	content, err = s.metadataGet(request)
 	if err != nil {
 		return []byte{}, err
 	}
+	return content, nil
+}
+
+//get response body of metadata service, transport failure and status other than 2xx are returned as *MetadataError
+func (s *Session) metadataGet(request string) ([]byte, error) {
+	resp, err := s.metadataClient.Get(request)
+	if err != nil {
+		return nil, &MetadataError{Url: request, Err: err}
+	}
 	defer resp.Body.Close()
-	content, err = ioutil.ReadAll(resp.Body)
+	content, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return content, err
+		return content, &MetadataError{Url: request, Err: err}
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return content, &MetadataError{Url: request, StatusCode: resp.StatusCode}
 	}
 	return content, nil
 }
-func (s *session) disconnect() {
+
+//get sub device metadata, not found status is returned as ErrModelNotFound
+func (s *Session) metadataDevice(request string) ([]byte, error) {
+	content, err := s.metadataGet(request)
+	if metaErr, ok := err.(*MetadataError); ok && metaErr.StatusCode == http.StatusNotFound {
+		metaErr.Err = ErrModelNotFound
+	}
+	return content, err
+}
+
+//close session, end clients are closed, edge services are unregistered and hub is disconnected.
+//the session can't be used after close
+func (s *Session) Close(ctx context.Context) error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	//publish offline before clients are unregistered, so the retained status keeps all devices of driver.
+	//clean disconnect does not trigger will message
+	if s.driverWill && atomic.LoadUint32(&s.status) == hubConnected {
+		if statusErr := s.publishDriverStatus(offline); statusErr != nil && s.logger != nil {
+			s.logger.Warn("[sdk] publish driver status failed:", statusErr.Error())
+		}
+	}
+	for _, e := range s.endClients() {
+		if closeErr := e.Close(ctx); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	s.edgeLock.Lock()
+	services := make([]string, 0, len(s.edgeServices))
+	for serviceId := range s.edgeServices {
+		services = append(services, serviceId)
+	}
+	s.edgeLock.Unlock()
+	for _, serviceId := range services {
+		if closeErr := s.UnregisterEdgeService(serviceId); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	if s.dispatcher != nil {
+		s.dispatcher.stop()
+	}
+	s.disconnect()
+	s.state.set(StateClosed, nil)
+	return err
+}
+
+func (s *Session) disconnect() {
 	if s.client != nil {
 		s.client.Disconnect(250)
-		atomic.StoreUint32(&s.status, hubConnected)
+		atomic.StoreUint32(&s.status, hubNotConnected)
+		s.state.set(StateDisconnected, nil)
 		s.connectLost = nil
 	}
 	if s.metadataClient != nil {
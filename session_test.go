@@ -17,45 +17,234 @@
 package edge_driver_go
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"os"
 	"testing"
 	"time"
 )
 
 func TestConnect(t *testing.T) {
-	getSessionIns().init()
-	getSessionIns().setConfigChange(func(tp string, config []byte) {
+	integrationTest(t)
+	s, err := NewSession()
+	assert.Nil(t, err)
+	err = s.Connect(context.Background())
+	assert.Nil(t, err)
+	s.SetConfigChange(func(tp string, config []byte) {
 		fmt.Println("config change:", tp, string(config))
 	})
-	err := getSessionIns().publish("/iot/internal/notify/edgeDeviceChanged", []byte("hello world"))
+	err = s.publish("/iot/internal/notify/edgeDeviceChanged", []byte("hello world"), s.policy(OtherMessage))
 	assert.Nil(t, err)
-	err = getSessionIns().subscribe("/sys/1/2/thing/service/set/call", func(topic string, payload []byte) {
+	err = s.subscribe("/sys/1/2/thing/service/set/call", s.policy(SubscribeMessage).qos, func(topic string, payload []byte) {
 		fmt.Println("subscribe:", topic, string(payload))
 	})
 	assert.Nil(t, err)
-	err = getSessionIns().publish("/sys/1/2/thing/service/set/call", []byte("call hello world"))
+	err = s.publish("/sys/1/2/thing/service/set/call", []byte("call hello world"), s.policy(OtherMessage))
 	assert.Nil(t, err)
 	time.Sleep(3 * time.Second)
 }
 func TestRequestEdge(t *testing.T) {
-	res, err := getSessionIns().getEdgeInfo()
+	integrationTest(t)
+	s, err := DefaultSession()
+	assert.Nil(t, err)
+	res, err := s.getEdgeInfo()
 	assert.Nil(t, err)
 	fmt.Println(res)
 }
 func TestRequestDriver(t *testing.T) {
-	res, err := getSessionIns().getDriver()
+	integrationTest(t)
+	s, err := DefaultSession()
+	assert.Nil(t, err)
+	res, err := s.getDriver()
 	assert.Nil(t, err)
 	fmt.Println(res)
 }
 
 func TestGetModel(t *testing.T) {
-	res, err := getSessionIns().getModel("iotd-0adf702f-8c1c-489e-bde0-01788ac674c3")
+	integrationTest(t)
+	s, err := DefaultSession()
+	assert.Nil(t, err)
+	res, err := s.getModel("iotd-0adf702f-8c1c-489e-bde0-01788ac674c3")
 	assert.Nil(t, err)
 	fmt.Println(res)
 }
 func TestGetEdgeInfo(t *testing.T) {
-	res, err := getSessionIns().getEdgeInfo()
+	integrationTest(t)
+	s, err := DefaultSession()
+	assert.Nil(t, err)
+	res, err := s.getEdgeInfo()
 	assert.Nil(t, err)
 	fmt.Println(res)
 }
+//set environment variable, the returned func restores it
+func setenv(key, value string) func() {
+	previous, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+func TestNewSessionWithoutDriverId(t *testing.T) {
+	defer setenv("EDGE_APP_ID", "")()
+	_, err := NewSession(SetEdgeDevice("iotd-edge", "iott-edge"))
+	assert.NotNil(t, err)
+}
+func TestNewSessionWithoutEdgeDevice(t *testing.T) {
+	defer setenv("EDGE_DEVICE_ID", "")()
+	defer setenv("EDGE_THING_ID", "")()
+	_, err := NewSession(SetDriverId("driver"))
+	assert.NotNil(t, err)
+}
+func TestConnectUnreachable(t *testing.T) {
+	s, err := NewSession(SetDriverId("driver"), SetEdgeDevice("iotd-edge", "iott-edge"),
+		SetHubAddress("tcp://127.0.0.1:1"),
+		SetConnectBackoff(Backoff{Initial: 10 * time.Millisecond, Multiplier: 2, MaxAttempts: 2}))
+	assert.Nil(t, err)
+	err = s.Connect(context.Background())
+	var connectErr *ConnectError
+	assert.True(t, errors.As(err, &connectErr))
+	assert.Equal(t, 2, connectErr.Attempts)
+	assert.Equal(t, "tcp://127.0.0.1:1", connectErr.Address)
+}
+func TestConnectCancel(t *testing.T) {
+	s, err := NewSession(SetDriverId("driver"), SetEdgeDevice("iotd-edge", "iott-edge"),
+		SetHubAddress("tcp://127.0.0.1:1"),
+		SetConnectBackoff(Backoff{Initial: time.Minute}))
+	assert.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = s.Connect(ctx)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+func TestConnectWaitCancel(t *testing.T) {
+	s, err := NewSession(SetDriverId("driver"), SetEdgeDevice("iotd-edge", "iott-edge"),
+		SetHubAddress("tcp://127.0.0.1:1"),
+		SetConnectBackoff(Backoff{Initial: time.Minute}))
+	assert.Nil(t, err)
+	background := make(chan error, 1)
+	go func() {
+		background <- s.Connect(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = s.Connect(ctx)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Nil(t, s.Close(context.Background()))
+	assert.True(t, errors.Is(<-background, ErrSessionClosed))
+}
+func TestDriverWill(t *testing.T) {
+	session := newTestSession(t)
+	var msg message
+	statusTopic := msg.buildDriverStatusTopic("iotd-edge", "driver")
+	devicesTopic := msg.buildDriverDevicesTopic("iotd-edge", "driver")
+	reader := session.client.OptionsReader()
+	assert.True(t, reader.WillEnabled())
+	assert.True(t, reader.WillRetained())
+	assert.Equal(t, statusTopic, reader.WillTopic())
+	will := &driverStatus{}
+	assert.Nil(t, json.Unmarshal(reader.WillPayload(), will))
+	assert.Equal(t, offline, will.Status)
+
+	//device list is kept on a topic the will does not overwrite
+	assert.NotEqual(t, reader.WillTopic(), devicesTopic)
+	client, err := NewEndClient(newTestToken(t, testTokenKey, time.Time{}), SetSession(session))
+	assert.Nil(t, err)
+	fake := connectFake(session)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	assert.Nil(t, client.Online(ctx))
+	var last *fakeMessage
+	for _, m := range fake.messages() {
+		if m.topic == devicesTopic {
+			last = m
+		}
+	}
+	assert.NotNil(t, last)
+	if last != nil {
+		assert.True(t, last.retained)
+		devices := &driverDevices{}
+		assert.Nil(t, json.Unmarshal(last.payload, devices))
+		assert.Equal(t, []*driverDevice{{DeviceId: "iotd-test", ThingId: "iott-test"}}, devices.Devices)
+	}
+}
+
+func TestSessionClientId(t *testing.T) {
+	s := newTestSession(t)
+	reader := s.client.OptionsReader()
+	assert.Equal(t, "edge.go.iotd-edge.driver", reader.ClientID())
+	other := newTestSession(t, SetEdgeDevice("iotd-other", "iott-edge"))
+	reader = other.client.OptionsReader()
+	assert.Equal(t, "edge.go.iotd-other.driver", reader.ClientID())
+	custom := newTestSession(t, SetClientId("custom"))
+	reader = custom.client.OptionsReader()
+	assert.Equal(t, "custom", reader.ClientID())
+}
+
+func TestBackoffNext(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 5 * time.Second, Multiplier: 2}
+	assert.Equal(t, time.Second, b.next(1))
+	assert.Equal(t, 4*time.Second, b.next(3))
+	assert.Equal(t, 5*time.Second, b.next(10))
+	b.Jitter = 0.5
+	for i := 0; i < 10; i++ {
+		d := b.next(2)
+		assert.True(t, d >= time.Second && d <= 3*time.Second)
+	}
+}
+func TestBackoffDefaults(t *testing.T) {
+	tests := []struct {
+		backoff  Backoff
+		attempt  int
+		expected time.Duration
+	}{
+		{Backoff{}, 1, time.Second},
+		{Backoff{}, 2, 2 * time.Second},
+		{Backoff{}, 10, 30 * time.Second},
+		{Backoff{Max: 30 * time.Second}, 3, 4 * time.Second},
+		{Backoff{Initial: 100 * time.Millisecond}, 2, 200 * time.Millisecond},
+		{Backoff{Initial: time.Minute}, 3, time.Minute},
+		{Backoff{Initial: time.Second, Multiplier: 0.5}, 5, time.Second},
+		{Backoff{Initial: time.Second, Multiplier: -1}, 2, time.Second},
+		{Backoff{Initial: time.Second, Max: 3 * time.Second, Multiplier: 10}, 2, 3 * time.Second},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.backoff.next(test.attempt), "%+v attempt %d", test.backoff, test.attempt)
+	}
+}
+func TestSessionQoS(t *testing.T) {
+	s, err := NewSession(SetDriverId("driver"), SetEdgeDevice("iotd-edge", "iott-edge"),
+		SetQoS(PropertyMessage, 1), SetRetained(StatusMessage, false))
+	assert.Nil(t, err)
+	assert.Equal(t, byte(1), s.policy(PropertyMessage).qos)
+	assert.Equal(t, byte(0), s.policy(EventMessage).qos)
+	assert.False(t, s.policy(StatusMessage).retained)
+	s, err = NewSession(SetDriverId("driver"), SetEdgeDevice("iotd-edge", "iott-edge"))
+	assert.Nil(t, err)
+	assert.True(t, s.policy(StatusMessage).retained)
+	_, err = NewSession(SetDriverId("driver"), SetEdgeDevice("iotd-edge", "iott-edge"), SetQoS(EventMessage, 3))
+	assert.Equal(t, ErrInvalidQos, err)
+}
+
+func TestSessionSubscribeKeep(t *testing.T) {
+	session, err := NewSession(SetDriverId("driver"), SetEdgeDevice("iotd-edge", "iott-edge"), SetHubAddress("tcp://127.0.0.1:1"))
+	assert.Nil(t, err)
+	assert.Nil(t, session.Subscribe("/user/topic", 1, func(topic string, payload []byte) {}))
+	assert.Equal(t, ErrInvalidQos, session.Subscribe("/user/topic", 3, func(topic string, payload []byte) {}))
+	assert.Nil(t, session.RegisterEdgeService("reboot", func(args Metadata) (*Reply, error) {
+		return nil, nil
+	}))
+	assert.Equal(t, 2, len(session.subscriptions))
+	assert.Nil(t, session.Unsubscribe("/user/topic"))
+	assert.Nil(t, session.UnregisterEdgeService("reboot"))
+	assert.Equal(t, 0, len(session.subscriptions))
+}
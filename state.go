@@ -0,0 +1,143 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package edge_driver_go
+
+import "sync"
+
+//hub connection state
+type State int
+
+const (
+	StateDisconnected State = iota //not connected, Connect is not called or failed
+	StateConnecting                //Connect is in progress
+	StateConnected                 //connected to hub, subscriptions and statuses are restored and offline queue replay is started
+	StateReconnecting              //connection lost, reconnecting automatically
+	StateClosed                    //session closed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+//state change call, err is the cause of change, nil if not caused by error
+type StateChange func(from, to State, err error)
+
+type stateChange struct {
+	from, to  State
+	err       error
+	observers []StateChange
+}
+
+//state and observers of session, changes are delivered in order by one goroutine
+type stateObserver struct {
+	lock      sync.Mutex
+	state     State
+	nextId    int
+	observers map[int]StateChange
+	pending   []*stateChange //changes not delivered yet
+	notifying bool           //notify goroutine is running
+}
+
+func newStateObserver() *stateObserver {
+	return &stateObserver{
+		state:     StateDisconnected,
+		observers: make(map[int]StateChange),
+	}
+}
+
+func (o *stateObserver) get() State {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.state
+}
+
+//set state and queue notification of observers, closed state is final
+func (o *stateObserver) set(state State, err error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	from := o.state
+	if from == state || from == StateClosed {
+		return
+	}
+	o.state = state
+	if len(o.observers) == 0 {
+		return
+	}
+	change := &stateChange{from: from, to: state, err: err, observers: make([]StateChange, 0, len(o.observers))}
+	for _, call := range o.observers {
+		change.observers = append(change.observers, call)
+	}
+	o.pending = append(o.pending, change)
+	if !o.notifying {
+		o.notifying = true
+		go o.notify()
+	}
+}
+
+//deliver pending changes in order, exit when there is nothing left
+func (o *stateObserver) notify() {
+	for {
+		o.lock.Lock()
+		if len(o.pending) == 0 {
+			o.notifying = false
+			o.lock.Unlock()
+			return
+		}
+		change := o.pending[0]
+		o.pending = o.pending[1:]
+		o.lock.Unlock()
+		for _, call := range change.observers {
+			call(change.from, change.to, change.err)
+		}
+	}
+}
+
+func (o *stateObserver) watch(call StateChange) func() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	id := o.nextId
+	o.nextId++
+	o.observers[id] = call
+	return func() {
+		o.lock.Lock()
+		defer o.lock.Unlock()
+		delete(o.observers, id)
+	}
+}
+
+//get hub connection state
+func (s *Session) State() State {
+	return s.state.get()
+}
+
+//watch state changes, call is called in order of changes on a separate goroutine,
+//so it may call session methods. the returned func stops watching
+func (s *Session) WatchState(call StateChange) (stop func()) {
+	return s.state.watch(call)
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package edge_driver_go
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionState(t *testing.T) {
+	session := newTestSession(t, SetConnectBackoff(Backoff{Initial: time.Millisecond, MaxAttempts: 1}))
+	assert.Equal(t, StateDisconnected, session.State())
+	changes := make(chan State, 10)
+	var cause error
+	stop := session.WatchState(func(from, to State, err error) {
+		if err != nil {
+			cause = err
+		}
+		changes <- to
+	})
+	assert.NotNil(t, session.Connect(context.Background()))
+	assert.Equal(t, StateConnecting, <-changes)
+	assert.Equal(t, StateDisconnected, <-changes)
+	assert.IsType(t, &ConnectError{}, cause)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, session.Close(ctx))
+	assert.Equal(t, StateClosed, session.State())
+	var last State
+	for last != StateClosed {
+		select {
+		case last = <-changes:
+		case <-time.After(time.Second):
+			t.Fatal("closed state not notified")
+		}
+	}
+	stop()
+	session.state.set(StateConnected, nil)
+	assert.Equal(t, StateClosed, session.State())
+	assert.Equal(t, "reconnecting", StateReconnecting.String())
+}
+
+func TestStateOrder(t *testing.T) {
+	o := newStateObserver()
+	done := make(chan struct{})
+	var (
+		lock    sync.Mutex
+		last    = StateDisconnected
+		ordered = true
+		count   int
+	)
+	o.watch(func(from, to State, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if from != last {
+			ordered = false
+		}
+		last = to
+		count++
+		if to == StateClosed {
+			close(done)
+		}
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				o.set(StateConnecting, nil)
+				o.set(StateConnected, nil)
+			}
+		}()
+	}
+	wg.Wait()
+	o.set(StateClosed, nil)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("closed state not notified")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	assert.True(t, ordered)
+	assert.True(t, count > 1)
+}
+
+func TestConnectedState(t *testing.T) {
+	session := newTestSession(t, SetDriverWill(false))
+	fake := &fakeClient{}
+	session.client = fake
+	//connected state is set after subscriptions are restored, not when connect returns
+	assert.Nil(t, session.connect(context.Background()))
+	assert.Equal(t, StateDisconnected, session.State())
+	session.onConnect(fake)
+	assert.Equal(t, StateConnected, session.State())
+}
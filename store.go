@@ -17,10 +17,28 @@ package edge_driver_go
 
 //设置key value
 func SetValue(key string, value []byte) error {
-	return getSessionIns().setValue(key, value)
+	s, err := DefaultSession()
+	if err != nil {
+		return err
+	}
+	return s.SetValue(key, value)
 }
 
 //获取key value
 func GetValue(key string) ([]byte, error) {
-	return getSessionIns().getValue(key)
+	s, err := DefaultSession()
+	if err != nil {
+		return nil, err
+	}
+	return s.GetValue(key)
+}
+
+//设置key value
+func (s *Session) SetValue(key string, value []byte) error {
+	return s.setValue(key, value)
+}
+
+//获取key value
+func (s *Session) GetValue(key string) ([]byte, error) {
+	return s.getValue(key)
 }
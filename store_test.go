@@ -6,6 +6,7 @@ import (
 )
 
 func TestSetValue(t *testing.T) {
+	integrationTest(t)
 	err := SetValue("test", []byte("xxxxxxx"))
 	assert.Nil(t, err)
 }
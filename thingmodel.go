@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package edge_driver_go
+
+import "encoding/json"
+
+func newThingModel() *ThingModel {
+	return &ThingModel{
+		Properties: make(map[string]*Property),
+		Events:     make(map[string]*Event),
+		Services:   make(map[string]*Service),
+	}
+}
+
+//convert metadata properties, property with invalid define or ext is skipped
+func newProperties(list []*propertyEx) map[string]*Property {
+	properties := make(map[string]*Property)
+	for _, v := range list {
+		p := &Property{
+			Name:       v.Name,
+			Identifier: v.Identifier,
+			Type:       DefineType(v.Type).String(),
+			Define:     make(map[string]interface{}),
+			Ext:        make(map[string]interface{}),
+		}
+		if v.Define != nil {
+			if err := json.Unmarshal(v.Define, &p.Define); err != nil {
+				continue
+			}
+		}
+		if v.Ext != nil {
+			if err := json.Unmarshal(v.Ext, &p.Ext); err != nil {
+				continue
+			}
+		}
+		properties[v.Identifier] = p
+	}
+	return properties
+}
+
+//thing model of sub device metadata
+func (d *device) thingModel() *ThingModel {
+	model := newThingModel()
+	model.Properties = newProperties(d.Properties)
+	for _, v := range d.Events {
+		model.Events[v.Identifier] = &Event{
+			Name:       v.Name,
+			Identifier: v.Identifier,
+			Params:     newProperties(v.Output),
+		}
+	}
+	for _, v := range d.Services {
+		model.Services[v.Identifier] = &Service{
+			Name:       v.Name,
+			Identifier: v.Identifier,
+			Input:      newProperties(v.Input),
+			Output:     newProperties(v.Output),
+		}
+	}
+	return model
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package edge_driver_go
+
+import (
+	"time"
+)
+
+//schedule token expiry callback, the previous schedule is canceled
+func (e *endClient) watchTokenExpiry() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.expiryTimer != nil {
+		e.expiryTimer.Stop()
+		e.expiryTimer = nil
+	}
+	expiresAt := e.config.ExpiresAt()
+	if e.tokenExpiryCall == nil || expiresAt.IsZero() || e.ctx.Err() != nil {
+		return
+	}
+	deviceId := e.config.DeviceId()
+	call := e.tokenExpiryCall
+	e.expiryTimer = time.AfterFunc(time.Until(expiresAt.Add(-e.tokenExpiryBefore)), func() {
+		if e.ctx.Err() != nil {
+			return
+		}
+		call(deviceId, expiresAt)
+	})
+}
+
+//re-fetch sub device token from metadata service, called when sub device config changed.
+//the client goes offline when token is disabled, and back online when token is enabled again
+func (e *endClient) refreshToken() {
+	dev, err := e.session.getSubDevice(e.config.DeviceId())
+	if err != nil {
+		if e.logger != nil {
+			e.logger.Warn("[sdk] refresh token failed:", e.config.DeviceId(), err.Error())
+		}
+		return
+	}
+	if dev.TokenContent != "" && dev.TokenContent != e.config.Token() {
+		if err = e.config.update(dev.TokenContent, e.tokenKeyFunc); err != nil {
+			if e.logger != nil {
+				e.logger.Error("[sdk] refresh token invalid:", e.config.DeviceId(), err.Error())
+			}
+		} else {
+			if e.logger != nil {
+				e.logger.Info("[sdk] token refreshed:", e.config.DeviceId())
+			}
+			e.watchTokenExpiry()
+		}
+	}
+	err = nil
+	e.lock.Lock()
+	previous := e.tokenStatus
+	//status is kept if metadata response does not carry it
+	if dev.TokenStatus != "" {
+		e.tokenStatus = TokenStatus(dev.TokenStatus)
+	}
+	current := e.tokenStatus
+	e.lock.Unlock()
+	//declared status is kept, so the client recovers online when token is enabled again
+	switch {
+	case current == Disable && previous != Disable:
+		if e.getStatus() == online {
+			err = e.publishStatus(offline)
+		}
+	case current != Disable && previous == Disable:
+		if e.liveStatus() == online {
+			err = e.publishStatus(online)
+		}
+	}
+	if err != nil && e.logger != nil {
+		e.logger.Warn("[sdk] publish device status failed:", e.config.DeviceId(), err.Error())
+	}
+}
+
+//get status declared by Online and Offline
+func (e *endClient) getStatus() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.status
+}
+
+func (e *endClient) tokenDisabled() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.tokenStatus == Disable
+}
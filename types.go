@@ -17,6 +17,11 @@ package edge_driver_go
 
 import (
 	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
 )
 
 type TokenStatus string
@@ -56,12 +61,14 @@ func (d DefineType) String() string {
 const (
 	messageVersion    = "v0.0.1"
 	hubBroker         = "tcp://127.0.0.1:1883"
+	hubTLSBroker      = "ssl://127.0.0.1:8883"
 	metadataBroker    = "http://127.0.0.1:9611"
 	edgeInfoRequest   = "%s/internal/data/edgeInfo/"   //request edge info
 	edgeDriverRequest = "%s/internal/data/edgeDriver/" //request driver info
 	subDeviceRequest  = "%s/internal/data/childDevice/"
 	userThingId       = "iott-end-user-system"
 	storeRequest      = "%s/public/data/"
+	tokenKeyRequest   = "%s/internal/data/tokenKey/" //request sub device token verify key
 )
 const (
 	EdgeDeviceChanged   = "edgeDeviceChanged"   //edge device config change
@@ -77,7 +84,16 @@ const (
 
 const (
 	RpcSuccess = 200 //success
-	RpcFail    = 201 //rpc timeout
+	RpcFail    = 201 //rpc failed, handler returned error without code
+)
+
+//service reply error code
+const (
+	RpcInvalidParams = 400 //service args or reply data mismatch thing model
+	RpcUnsupported   = 404 //service method not supported
+	RpcInternalError = 500 //handler internal error
+	RpcDeviceBusy    = 503 //device is busy, try later
+	RpcTimeout       = 504 //handler timeout
 )
 
 const (
@@ -95,13 +111,229 @@ const (
 	deviceEventType           = "thing.event.%s.post"
 )
 
+//sdk errors, returned errors may wrap them and should be checked by errors.Is
+var (
+	ErrTimeout             = errors.New("rpc timeout")                  //call is not finished before ctx is done
+	ErrNotConnected        = errors.New("hub not connected")            //hub is not connected, ConnectError also matches
+	ErrInvalidTopic        = errors.New("parse topic error")            //topic can't be parsed
+	ErrQueueFull           = errors.New("offline queue is full")        //report is dropped by offline queue
+	ErrInvalidQos          = errors.New("qos must be 0, 1 or 2")        //invalid qos option
+	ErrTokenInvalid        = errors.New("device token is invalid")      //token is empty or TokenError
+	ErrTokenDisabled       = errors.New("device token is disabled")     //token is disabled by metadata service
+	ErrSessionClosed       = errors.New("session closed")               //session is closed
+	ErrModelNotFound       = errors.New("thing model not found")        //device is not found by metadata service
+	ErrMetadataUnavailable = errors.New("metadata service unavailable") //MetadataError of transport failure or 5xx status
+)
+
+//report delivery errors
 var (
-	rpcTimeout      = errors.New("rpc timeout")
-	notConnected    = errors.New("hub not connected")
-	pubMessageError = errors.New("pub message fail")
-	topicError      = errors.New("parse topic error")
+	//report is not acknowledged before ctx is done. a message already handed to mqtt client can't be cancelled
+	//and may still be delivered, so retrying the report is at least once, see Receipt.Unknown
+	ErrPublishTimeout  = fmt.Errorf("publish timeout: %w", ErrTimeout)
+	ErrPublishRejected = errors.New("publish rejected") //message is rejected by mqtt client or broker
 )
 
+//metadata service error, StatusCode is 0 if no response is received
+type MetadataError struct {
+	Url        string //request url
+	StatusCode int    //response status code
+	Err        error  //transport, read or decode error
+}
+
+func (e *MetadataError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("metadata request %s failed: %v", e.Url, e.Err)
+	}
+	if e.Err == nil {
+		return fmt.Sprintf("metadata request %s failed, status:%d", e.Url, e.StatusCode)
+	}
+	return fmt.Sprintf("metadata request %s failed, status:%d: %v", e.Url, e.StatusCode, e.Err)
+}
+func (e *MetadataError) Unwrap() error {
+	return e.Err
+}
+func (e *MetadataError) Is(target error) bool {
+	return target == ErrMetadataUnavailable && (e.StatusCode == 0 || e.StatusCode >= http.StatusInternalServerError)
+}
+
+//message class, qos and retain can be set for each class
+type MessageClass int
+
+const (
+	PropertyMessage     MessageClass = iota //property report
+	EventMessage                            //event report
+	StatusMessage                           //device online/offline status
+	ServiceReplyMessage                     //service call reply
+	SubscribeMessage                        //subscription of service call, set and get topics
+	OtherMessage                            //device info, discovery and user message
+	messageClassCount
+)
+
+type publishPolicy struct {
+	qos      byte
+	retained bool
+}
+
+//hub connect error, returned when hub can't be reached
+type ConnectError struct {
+	Address  string //hub broker address
+	Attempts int    //connect attempts
+	Err      error  //last connect error or ctx error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("connect hub %s failed after %d attempts: %v", e.Address, e.Attempts, e.Err)
+}
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+func (e *ConnectError) Is(target error) bool {
+	return target == ErrNotConnected
+}
+
+//verify key of sub device token, alg is the token signing method,
+//key is []byte for HMAC, *rsa.PublicKey for RSA and *ecdsa.PublicKey for ECDSA
+type TokenKeyFunc func(alg string, claims map[string]interface{}) (interface{}, error)
+
+type TokenErrorReason string
+
+const (
+	TokenMalformed   TokenErrorReason = "malformed"     //token can't be parsed
+	TokenForged      TokenErrorReason = "forged"        //token signature is invalid
+	TokenExpired     TokenErrorReason = "expired"       //token is expired
+	TokenNotValidYet TokenErrorReason = "not valid yet" //token nbf or iat is in the future
+)
+
+//sub device token error
+type TokenError struct {
+	Reason TokenErrorReason
+	Err    error
+}
+
+func (e *TokenError) Error() string {
+	return fmt.Sprintf("token %s: %v", e.Reason, e.Err)
+}
+func (e *TokenError) Unwrap() error {
+	return e.Err
+}
+func (e *TokenError) Is(target error) bool {
+	return target == ErrTokenInvalid
+}
+
+//kept subscription
+type subscription struct {
+	qos  byte
+	call messageArrived
+}
+
+//service call error returned by handlers, code and message are sent in service reply
+type ServiceError struct {
+	Code    int         //reply code, see RpcInvalidParams and so on
+	Message string      //error message
+	Details interface{} //optional error details
+}
+
+func NewServiceError(code int, message string) *ServiceError {
+	return &ServiceError{Code: code, Message: message}
+}
+func (e *ServiceError) Error() string {
+	return fmt.Sprintf("service error %d: %s", e.Code, e.Message)
+}
+
+//property validate mode
+type ValidateMode int
+
+const (
+	ValidateLenient ValidateMode = iota //drop invalid properties and log, default
+	ValidateStrict                      //reject the report if any property is invalid
+	ValidateCoerce                      //convert values to thing model type, drop properties can't be converted
+)
+
+//invalid property detail
+type FieldError struct {
+	Field  string      `json:"field"`  //property identifier, nested field is joined by . and [index]
+	Reason string      `json:"reason"` //why the value is invalid
+	Value  interface{} `json:"value"`  //reported value
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Field, e.Reason, e.Value)
+}
+
+//properties validate error
+type ValidationError struct {
+	DeviceId string
+	Fields   []*FieldError
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		fields = append(fields, f.Error())
+	}
+	return fmt.Sprintf("device %s validate failed: %s", e.DeviceId, strings.Join(fields, "; "))
+}
+
+//connect retry backoff
+type Backoff struct {
+	Initial     time.Duration //first retry interval, default 1s if 0
+	Max         time.Duration //max retry interval, default 30s (or Initial if larger) if 0
+	Multiplier  float64       //interval multiplier for each retry, default 2 if 0, at least 1
+	Jitter      float64       //random jitter factor in [0,1]
+	MaxAttempts int           //max connect attempts, 0 is unlimited
+}
+
+var defaultBackoff = Backoff{
+	Initial:    time.Second,
+	Max:        30 * time.Second,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+//fill zero fields by default backoff, so retry never runs in a tight loop
+func (b Backoff) normalize() Backoff {
+	if b.Initial <= 0 {
+		b.Initial = defaultBackoff.Initial
+	}
+	if b.Max <= 0 {
+		b.Max = defaultBackoff.Max
+		if b.Initial > b.Max {
+			b.Max = b.Initial
+		}
+	}
+	if b.Multiplier == 0 {
+		b.Multiplier = defaultBackoff.Multiplier
+	} else if b.Multiplier < 1 {
+		b.Multiplier = 1
+	}
+	if b.Jitter < 0 {
+		b.Jitter = 0
+	} else if b.Jitter > 1 {
+		b.Jitter = 1
+	}
+	return b
+}
+
+//retry interval after attempt (start from 1)
+func (b Backoff) next(attempt int) time.Duration {
+	b = b.normalize()
+	interval := float64(b.Initial)
+	for i := 1; i < attempt; i++ {
+		interval *= b.Multiplier
+		if b.Max > 0 && interval >= float64(b.Max) {
+			interval = float64(b.Max)
+			break
+		}
+	}
+	if b.Jitter > 0 {
+		interval += interval * b.Jitter * (2*rand.Float64() - 1)
+	}
+	if interval < 0 {
+		return 0
+	}
+	return time.Duration(interval)
+}
+
 //device status report
 type deviceStatus struct {
 	DeviceId   string `json:"device_id"`
@@ -111,6 +343,27 @@ type deviceStatus struct {
 	NodeName   string `json:"node_name"`
 	RemoteAddr string `json:"remote_addr"`
 }
+
+//driver status report, the platform marks all devices of driver offline when driver is offline
+type driverStatus struct {
+	DriverId string          `json:"driver_id"`
+	DeviceId string          `json:"device_id"` //edge device id
+	ThingId  string          `json:"thing_id"`  //edge thing id
+	Status   string          `json:"status"`
+	Devices  []*driverDevice `json:"devices"`
+	Time     int64           `json:"time"`
+}
+type driverDevices struct {
+	DriverId string          `json:"driver_id"`
+	DeviceId string          `json:"device_id"` //edge device id
+	ThingId  string          `json:"thing_id"`  //edge thing id
+	Devices  []*driverDevice `json:"devices"`
+	Time     int64           `json:"time"`
+}
+type driverDevice struct {
+	DeviceId string `json:"device_id"`
+	ThingId  string `json:"thing_id"`
+}
 type property struct {
 	Value interface{} `json:"value"`
 	Time  int64       `json:"time"`
@@ -155,13 +408,39 @@ type serviceGetRequest struct {
 	Params  []string `json:"params"`
 }
 type Reply struct {
-	Code int         `json:"code"`
-	Data interface{} `json:"data"`
+	Code    int         `json:"code"`
+	Data    interface{} `json:"data"`
+	Message string      `json:"message"`
 }
 type serviceReply struct {
-	Code int         `json:"code"`
-	Id   string      `json:"id"`
-	Data interface{} `json:"data"`
+	Code    int         `json:"code"`
+	Id      string      `json:"id"`
+	Data    interface{} `json:"data"`
+	Message string      `json:"message,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+//set reply code and message by handler error, *ServiceError keeps its code,
+//*ValidationError is RpcInvalidParams and other errors are RpcFail
+func (r *serviceReply) setError(err error) {
+	var (
+		serviceErr  *ServiceError
+		validateErr *ValidationError
+	)
+	switch {
+	case errors.As(err, &serviceErr):
+		r.Code = serviceErr.Code
+		r.Message = serviceErr.Message
+		r.Details = serviceErr.Details
+	case errors.As(err, &validateErr):
+		r.Code = RpcInvalidParams
+		r.Message = validateErr.Error()
+		r.Details = validateErr.Fields
+	default:
+		r.Code = RpcFail
+		r.Message = err.Error()
+		r.Details = nil
+	}
 }
 
 //dev info
@@ -197,8 +476,21 @@ type Property struct {
 	Define     map[string]interface{} `json:"define"`
 	Ext        map[string]interface{} `json:"ext"`
 }
+type Event struct {
+	Name       string               `json:"name"`
+	Identifier string               `json:"identifier"`
+	Params     map[string]*Property `json:"output"` //event params
+}
+type Service struct {
+	Name       string               `json:"name"`
+	Identifier string               `json:"identifier"`
+	Input      map[string]*Property `json:"input"`  //service call args
+	Output     map[string]*Property `json:"output"` //service reply data
+}
 type ThingModel struct {
 	Properties map[string]*Property `json:"property"`
+	Events     map[string]*Event    `json:"event"`
+	Services   map[string]*Service  `json:"service"`
 }
 
 //device info
@@ -221,6 +513,17 @@ type propertyEx struct {
 	Define     []byte `json:"define"`
 	Ext        []byte `json:"ext"`
 }
+type eventEx struct {
+	Name       string        `json:"name"`
+	Identifier string        `json:"identifier"`
+	Output     []*propertyEx `json:"output"`
+}
+type serviceEx struct {
+	Name       string        `json:"name"`
+	Identifier string        `json:"identifier"`
+	Input      []*propertyEx `json:"input"`
+	Output     []*propertyEx `json:"output"`
+}
 
 //sub device info
 type device struct {
@@ -230,6 +533,8 @@ type device struct {
 	ThingId      string                 `json:"thingId"`
 	ConnectInfo  map[string]interface{} `json:"extendInfo"`
 	Properties   []*propertyEx          `json:"property"`
+	Events       []*eventEx             `json:"event"`
+	Services     []*serviceEx           `json:"service"`
 }
 
 //driver info
@@ -16,10 +16,12 @@
 package edge_driver_go
 
 import (
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"errors"
-	"strings"
+	"github.com/dgrijalva/jwt-go"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"time"
 )
 
 const (
@@ -27,49 +29,115 @@ const (
 	thing_id  = "thid"
 )
 
-func parseToken(tokenString string) (string, string, error) {
-	//token, _ := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-	//	return "", nil
-	//})
-	//if token == nil || token.Claims == nil {
-	//	return "", "", errors.New("parse token fail")
-	//}
-	//payload := token.Claims.(jwt.MapClaims)
-	//if err := payload.Valid(); err != nil {
-	//	return "", "", err
-	//}
+const tokenPollInterval = 100 * time.Millisecond
 
-	split := strings.Split(tokenString, ".")
-	if len(split) != 3 {
-		return "", "", errors.New("parse token fail")
+//claims of sub device token
+type tokenInfo struct {
+	deviceId  string
+	thingId   string
+	expiresAt time.Time //zero if token never expires
+}
+
+//parse sub device token, exp and nbf are always checked,
+//signature is verified only when key func is set
+func parseToken(tokenString string, keyFunc TokenKeyFunc) (*tokenInfo, error) {
+	var (
+		claims = jwt.MapClaims{}
+		err    error
+	)
+	if keyFunc == nil {
+		parser := &jwt.Parser{}
+		if _, _, err = parser.ParseUnverified(tokenString, claims); err != nil {
+			//unknown signing method is ok when signature is not verified
+			if vErr, ok := err.(*jwt.ValidationError); !ok || vErr.Errors != jwt.ValidationErrorUnverifiable {
+				return nil, newTokenError(err)
+			}
+		}
+		if err = claims.Valid(); err != nil {
+			return nil, newTokenError(err)
+		}
+	} else {
+		_, err = jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+			return keyFunc(token.Method.Alg(), claims)
+		})
+		if err != nil {
+			return nil, newTokenError(err)
+		}
 	}
-	data, err := base64.RawURLEncoding.DecodeString(split[1])
-	if err != nil {
-		return "", "", err
+	info := &tokenInfo{}
+	var ok bool
+	if info.deviceId, ok = claims[device_id].(string); !ok {
+		return nil, &TokenError{Reason: TokenMalformed, Err: errors.New("device id type error")}
 	}
-	payload := make(map[string]interface{})
-	if err != nil {
-		return "", "", err
+	if info.thingId, ok = claims[thing_id].(string); !ok {
+		return nil, &TokenError{Reason: TokenMalformed, Err: errors.New("thing id type error")}
 	}
-	err = json.Unmarshal(data, &payload)
-	id, ok := payload[device_id].(string)
-	if !ok {
-		return "", "", errors.New("device id type error")
+	if exp, ok := claims["exp"].(float64); ok {
+		info.expiresAt = time.Unix(int64(exp), 0)
 	}
-	thingId, ok := payload[thing_id].(string)
+	return info, nil
+}
+
+//convert jwt validation error to token error
+func newTokenError(err error) *TokenError {
+	vErr, ok := err.(*jwt.ValidationError)
 	if !ok {
-		return "", "", errors.New("device id type error")
+		return &TokenError{Reason: TokenMalformed, Err: err}
+	}
+	switch {
+	case vErr.Errors&jwt.ValidationErrorMalformed != 0:
+		return &TokenError{Reason: TokenMalformed, Err: err}
+	case vErr.Errors&(jwt.ValidationErrorSignatureInvalid|jwt.ValidationErrorUnverifiable) != 0:
+		return &TokenError{Reason: TokenForged, Err: err}
+	case vErr.Errors&jwt.ValidationErrorExpired != 0:
+		return &TokenError{Reason: TokenExpired, Err: err}
+	case vErr.Errors&(jwt.ValidationErrorNotValidYet|jwt.ValidationErrorIssuedAt) != 0:
+		return &TokenError{Reason: TokenNotValidYet, Err: err}
+	default:
+		return &TokenError{Reason: TokenMalformed, Err: err}
 	}
-	return id, thingId, nil
 }
 
 func wait(f func() error) <-chan error {
-	done := make(chan error)
+	done := make(chan error, 1)
 	go func() {
 		done <- f()
 	}()
 	return done
 }
+
+//wait mqtt token until complete or ctx done
+func waitToken(ctx context.Context, token mqtt.Token) error {
+	for !token.WaitTimeout(tokenPollInterval) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+	}
+	return token.Error()
+}
 func isUserDevice(id string) bool {
 	return id == userThingId
 }
+
+//convert service reply data to metadata, nil is empty metadata
+func toMetadata(data interface{}) (Metadata, error) {
+	switch v := data.(type) {
+	case nil:
+		return make(Metadata), nil
+	case Metadata:
+		return v, nil
+	case map[string]interface{}:
+		return v, nil
+	}
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	metadata := make(Metadata)
+	if err = json.Unmarshal(buf, &metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package edge_driver_go
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testTokenKey = []byte("secret")
+
+func newTestToken(t *testing.T, key []byte, exp time.Time) string {
+	claims := jwt.MapClaims{
+		device_id: "iotd-test",
+		thing_id:  "iott-test",
+	}
+	if !exp.IsZero() {
+		claims["exp"] = exp.Unix()
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+	assert.Nil(t, err)
+	return token
+}
+
+func TestParseToken(t *testing.T) {
+	exp := time.Now().Add(time.Hour)
+	token := newTestToken(t, testTokenKey, exp)
+	info, err := parseToken(token, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "iotd-test", info.deviceId)
+	assert.Equal(t, "iott-test", info.thingId)
+	assert.Equal(t, exp.Unix(), info.expiresAt.Unix())
+	info, err = parseToken(token, func(alg string, claims map[string]interface{}) (interface{}, error) {
+		return testTokenKey, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "iotd-test", info.deviceId)
+}
+func TestParseTokenError(t *testing.T) {
+	var tokenErr *TokenError
+	_, err := parseToken("xxx", nil)
+	assert.True(t, errors.As(err, &tokenErr))
+	assert.Equal(t, TokenMalformed, tokenErr.Reason)
+
+	_, err = parseToken(newTestToken(t, testTokenKey, time.Now().Add(-time.Hour)), nil)
+	assert.True(t, errors.As(err, &tokenErr))
+	assert.Equal(t, TokenExpired, tokenErr.Reason)
+
+	_, err = parseToken(newTestToken(t, []byte("forged"), time.Time{}), func(alg string, claims map[string]interface{}) (interface{}, error) {
+		return testTokenKey, nil
+	})
+	assert.True(t, errors.As(err, &tokenErr))
+	assert.Equal(t, TokenForged, tokenErr.Reason)
+}
+
+func TestMetadataTokenKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.Nil(t, err)
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(publicPEM)
+	}))
+	defer server.Close()
+	keyFunc := newTestSession(t, SetMetadataAddress(server.URL)).MetadataTokenKey()
+	claims := jwt.MapClaims{device_id: "iotd-test", thing_id: "iott-test"}
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+	assert.Nil(t, err)
+	_, err = parseToken(signed, keyFunc)
+	assert.Nil(t, err)
+
+	//HS256 token signed with the public key PEM as secret
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(publicPEM)
+	assert.Nil(t, err)
+	_, err = parseToken(forged, keyFunc)
+	assert.True(t, errors.Is(err, ErrTokenInvalid))
+}
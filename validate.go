@@ -15,68 +15,221 @@
  */
 package edge_driver_go
 
-import "context"
+import (
+	"context"
+	"fmt"
+)
 
-//todo need fix
 //validate device thing model
 type validate interface {
 	validateProperties(ctx context.Context, deviceId string, metadata Metadata) (Metadata, error)
 	validatePropertiesEx(ctx context.Context, deviceId string, metadata MetadataMsg) (MetadataMsg, error)
-	validateEvent(ctx context.Context, deviceId string, eventName string, metadata Metadata) error
-	validateServiceInput(ctx context.Context, deviceId string, serviceName string, metadata Metadata) error
-	validateServiceOutput(ctx context.Context, deviceId string, serviceName string, metadata Metadata) error
+	validatePropertyHistory(ctx context.Context, deviceId string, history map[string][]ValueData) (map[string][]ValueData, error)
+	validateEvent(ctx context.Context, deviceId string, eventName string, metadata Metadata) (Metadata, error)
+	validateServiceInput(ctx context.Context, deviceId string, serviceName string, metadata Metadata) (Metadata, error)
+	validateServiceOutput(ctx context.Context, deviceId string, serviceName string, metadata Metadata) (Metadata, error)
 }
 
 //validate device thing model
 type dataValidate struct {
+	session *Session
+	mode    ValidateMode
+	logger  Logger
 }
 
-func newDataValidate() validate {
-	return &dataValidate{}
+func newDataValidate(session *Session, mode ValidateMode, logger Logger) validate {
+	return &dataValidate{
+		session: session,
+		mode:    mode,
+		logger:  logger,
+	}
+}
+
+//check property value against thing model, the checked value is returned.
+//in strict mode unknown property is an error, otherwise it is dropped silently
+func (v *dataValidate) checkProperty(thing *ThingModel, k string, value interface{}) (interface{}, *FieldError) {
+	p, ok := thing.Properties[k]
+	if !ok {
+		return nil, &FieldError{Field: k, Reason: "unknown property", Value: value}
+	}
+	return checkValue(k, p.Type, p.Define, value, v.mode == ValidateCoerce)
+}
+
+//collect invalid fields, returns error in strict mode and log the dropped fields otherwise
+func (v *dataValidate) result(deviceId string, fields []*FieldError) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	err := &ValidationError{DeviceId: deviceId, Fields: fields}
+	if v.mode == ValidateStrict {
+		return err
+	}
+	if v.logger != nil {
+		v.logger.Warn("[sdk] drop invalid properties:", err.Error())
+	}
+	return nil
 }
 
 func (v *dataValidate) validateProperties(ctx context.Context, deviceId string, metadata Metadata) (Metadata, error) {
 	var (
-		thing *ThingModel
-		resp  Metadata
-		err   error
+		thing  *ThingModel
+		resp   Metadata
+		fields []*FieldError
+		err    error
 	)
 	resp = make(Metadata, 0)
-	if thing, err = getSessionIns().getModel(deviceId); err != nil {
+	if thing, err = v.session.getModel(deviceId); err != nil {
 		return resp, err
 	}
-	for k, _ := range metadata {
-		if _, ok := thing.Properties[k]; !ok {
+	for k := range metadata {
+		value, fieldErr := v.checkProperty(thing, k, metadata[k])
+		if fieldErr != nil {
+			if _, ok := thing.Properties[k]; ok || v.mode == ValidateStrict {
+				fields = append(fields, fieldErr)
+			}
 			continue
 		}
-		resp[k] = metadata[k]
+		resp[k] = value
+	}
+	if err = v.result(deviceId, fields); err != nil {
+		return make(Metadata, 0), err
 	}
 	return resp, nil
 }
 func (v *dataValidate) validatePropertiesEx(ctx context.Context, deviceId string, metadata MetadataMsg) (MetadataMsg, error) {
 	var (
-		thing *ThingModel
-		resp  MetadataMsg
-		err   error
+		thing  *ThingModel
+		resp   MetadataMsg
+		fields []*FieldError
+		err    error
 	)
 	resp = make(MetadataMsg, 0)
-	if thing, err = getSessionIns().getModel(deviceId); err != nil {
+	if thing, err = v.session.getModel(deviceId); err != nil {
 		return resp, err
 	}
-	for k, _ := range metadata {
-		if _, ok := thing.Properties[k]; !ok {
+	for k := range metadata {
+		value, fieldErr := v.checkProperty(thing, k, metadata[k].Value)
+		if fieldErr != nil {
+			if _, ok := thing.Properties[k]; ok || v.mode == ValidateStrict {
+				fields = append(fields, fieldErr)
+			}
 			continue
 		}
-		resp[k] = metadata[k]
+		resp[k] = ValueData{Value: value, Time: metadata[k].Time}
+	}
+	if err = v.result(deviceId, fields); err != nil {
+		return make(MetadataMsg, 0), err
 	}
 	return resp, nil
 }
-func (v *dataValidate) validateEvent(ctx context.Context, deviceId string, eventName string, metadata Metadata) error {
-	return nil
+
+//check each sample of property history, invalid samples are handled as properties by validate mode
+func (v *dataValidate) validatePropertyHistory(ctx context.Context, deviceId string, history map[string][]ValueData) (map[string][]ValueData, error) {
+	var (
+		thing  *ThingModel
+		resp   map[string][]ValueData
+		fields []*FieldError
+		err    error
+	)
+	resp = make(map[string][]ValueData)
+	if thing, err = v.session.getModel(deviceId); err != nil {
+		return resp, err
+	}
+	for k, samples := range history {
+		p, ok := thing.Properties[k]
+		if !ok {
+			if v.mode == ValidateStrict {
+				fields = append(fields, &FieldError{Field: k, Reason: "unknown property", Value: samples})
+			}
+			continue
+		}
+		for i, sample := range samples {
+			value, fieldErr := checkValue(fmt.Sprintf("%s[%d]", k, i), p.Type, p.Define, sample.Value, v.mode == ValidateCoerce)
+			if fieldErr != nil {
+				fields = append(fields, fieldErr)
+				continue
+			}
+			resp[k] = append(resp[k], ValueData{Value: value, Time: sample.Time})
+		}
+	}
+	if err = v.result(deviceId, fields); err != nil {
+		return make(map[string][]ValueData), err
+	}
+	return resp, nil
 }
-func (v *dataValidate) validateServiceInput(ctx context.Context, deviceId string, serviceName string, metadata Metadata) error {
-	return nil
+
+//check event and service params, unknown or invalid params are rejected in all modes
+func (v *dataValidate) checkParams(deviceId string, name string, params map[string]*Property, metadata Metadata) (Metadata, error) {
+	var fields []*FieldError
+	resp := make(Metadata, len(metadata))
+	for k := range metadata {
+		p, ok := params[k]
+		if !ok {
+			fields = append(fields, &FieldError{Field: name + "." + k, Reason: "unknown param", Value: metadata[k]})
+			continue
+		}
+		value, fieldErr := checkValue(name+"."+k, p.Type, p.Define, metadata[k], v.mode == ValidateCoerce)
+		if fieldErr != nil {
+			fields = append(fields, fieldErr)
+			continue
+		}
+		resp[k] = value
+	}
+	if len(fields) > 0 {
+		return metadata, &ValidationError{DeviceId: deviceId, Fields: fields}
+	}
+	return resp, nil
 }
-func (v *dataValidate) validateServiceOutput(ctx context.Context, deviceId string, serviceName string, metadata Metadata) error {
-	return nil
+
+//get thing model for event and service check, nil if model is unavailable
+func (v *dataValidate) model(deviceId string) *ThingModel {
+	thing, err := v.session.getModel(deviceId)
+	if err != nil {
+		if v.logger != nil {
+			v.logger.Warn("[sdk] thing model unavailable, skip validate:", deviceId, err.Error())
+		}
+		return nil
+	}
+	return thing
+}
+
+//events are not checked if thing model has no event defined or is unavailable
+func (v *dataValidate) validateEvent(ctx context.Context, deviceId string, eventName string, metadata Metadata) (Metadata, error) {
+	thing := v.model(deviceId)
+	if thing == nil || len(thing.Events) == 0 {
+		return metadata, nil
+	}
+	event, ok := thing.Events[eventName]
+	if !ok {
+		return metadata, &ValidationError{DeviceId: deviceId, Fields: []*FieldError{{Field: eventName, Reason: "unknown event"}}}
+	}
+	return v.checkParams(deviceId, eventName, event.Params, metadata)
+}
+
+//get service define, nil if thing model has no service defined or is unavailable,
+//service not defined in thing model is replied with RpcUnsupported
+func (v *dataValidate) service(deviceId string, serviceName string) (*Service, error) {
+	thing := v.model(deviceId)
+	if thing == nil || len(thing.Services) == 0 {
+		return nil, nil
+	}
+	service, ok := thing.Services[serviceName]
+	if !ok {
+		return nil, NewServiceError(RpcUnsupported, "unknown service: "+serviceName)
+	}
+	return service, nil
+}
+func (v *dataValidate) validateServiceInput(ctx context.Context, deviceId string, serviceName string, metadata Metadata) (Metadata, error) {
+	service, err := v.service(deviceId, serviceName)
+	if err != nil || service == nil {
+		return metadata, err
+	}
+	return v.checkParams(deviceId, serviceName, service.Input, metadata)
+}
+func (v *dataValidate) validateServiceOutput(ctx context.Context, deviceId string, serviceName string, metadata Metadata) (Metadata, error) {
+	service, err := v.service(deviceId, serviceName)
+	if err != nil || service == nil {
+		return metadata, err
+	}
+	return v.checkParams(deviceId, serviceName, service.Output, metadata)
 }
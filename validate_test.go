@@ -0,0 +1,205 @@
+/*
+ * Copyright (C) 2020 Yunify, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this work except in compliance with the License.
+ * You may obtain a copy of the License in the LICENSE file, or at:
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package edge_driver_go
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestModelServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&device{
+			DeviceId:     "iotd-test",
+			TokenContent: "token",
+			Properties: []*propertyEx{
+				{Identifier: "temp", Type: 1, Define: []byte(`{"min":"0","max":"100","step":"1"}`)},
+				{Identifier: "name", Type: 4, Define: []byte(`{"length":4}`)},
+				{Identifier: "mode", Type: 5, Define: []byte(`{"enum":{"0":"off","1":"on"}}`)},
+			},
+			Events: []*eventEx{
+				{Identifier: "alarm", Output: []*propertyEx{{Identifier: "level", Type: 1, Define: []byte(`{"max":3}`)}}},
+			},
+			Services: []*serviceEx{
+				{
+					Identifier: "reboot",
+					Input:      []*propertyEx{{Identifier: "delay", Type: 1}},
+					Output:     []*propertyEx{{Identifier: "ok", Type: 7}},
+				},
+			},
+		})
+	}))
+}
+
+func TestCheckValue(t *testing.T) {
+	define := map[string]interface{}{"min": 0.0, "max": 10.0, "step": 0.5}
+	_, err := checkValue("f", "FLOAT", define, 2.5, false)
+	assert.Nil(t, err)
+	_, err = checkValue("f", "FLOAT", define, 2.4, false)
+	assert.NotNil(t, err)
+	_, err = checkValue("f", "FLOAT", define, 11, false)
+	assert.NotNil(t, err)
+	_, err = checkValue("i", "INT32", nil, int64(1)<<40, false)
+	assert.NotNil(t, err)
+	_, err = checkValue("i", "INT32", nil, "12", false)
+	assert.NotNil(t, err)
+	v, err := checkValue("i", "INT32", nil, "12", true)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(12), v)
+	v, err = checkValue("b", "BOOL", nil, "true", true)
+	assert.Nil(t, err)
+	assert.Equal(t, true, v)
+	_, err = checkValue("d", "DATE", nil, 1600000000000, false)
+	assert.Nil(t, err)
+
+	array := map[string]interface{}{"size": 2, "item": map[string]interface{}{"type": "INT32", "max": 5}}
+	_, err = checkValue("a", "ARRAY", array, []interface{}{1, 2}, false)
+	assert.Nil(t, err)
+	_, err = checkValue("a", "ARRAY", array, []int{1, 2, 3}, false)
+	assert.NotNil(t, err)
+	_, err = checkValue("a", "ARRAY", array, []interface{}{1, 6}, false)
+	assert.Equal(t, "a[1]", err.Field)
+
+	object := map[string]interface{}{"fields": []interface{}{
+		map[string]interface{}{"identifier": "x", "type": 2},
+		map[string]interface{}{"identifier": "y", "type": "STRING"},
+	}}
+	_, err = checkValue("s", "STRUCT", object, map[string]interface{}{"x": 1.5, "y": "a"}, false)
+	assert.Nil(t, err)
+	_, err = checkValue("s", "STRUCT", object, map[string]interface{}{"x": "a"}, false)
+	assert.Equal(t, "s.x", err.Field)
+	_, err = checkValue("s", "STRUCT", object, map[string]interface{}{"z": 1}, false)
+	assert.Equal(t, "s.z", err.Field)
+
+	//only schema key names are used
+	_, err = checkValue("n", "STRING", map[string]interface{}{"maxLength": 1}, "abc", false)
+	assert.Nil(t, err)
+}
+
+func TestValidateProperties(t *testing.T) {
+	server := newTestModelServer()
+	defer server.Close()
+	session := newTestSession(t, SetMetadataAddress(server.URL))
+	params := Metadata{"temp": 20, "name": "toolong", "mode": 2, "unknown": 1}
+
+	data, err := newDataValidate(session, ValidateLenient, nil).validateProperties(context.Background(), "iotd-test", params)
+	assert.Nil(t, err)
+	assert.Equal(t, Metadata{"temp": 20}, data)
+
+	_, err = newDataValidate(session, ValidateStrict, nil).validateProperties(context.Background(), "iotd-test", params)
+	validateErr, ok := err.(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "iotd-test", validateErr.DeviceId)
+	assert.Len(t, validateErr.Fields, 3)
+
+	data, err = newDataValidate(session, ValidateCoerce, nil).validateProperties(context.Background(), "iotd-test",
+		Metadata{"temp": "20", "mode": "1"})
+	assert.Nil(t, err)
+	assert.Equal(t, Metadata{"temp": int32(20), "mode": int64(1)}, data)
+
+	dataEx, err := newDataValidate(session, ValidateCoerce, nil).validatePropertiesEx(context.Background(), "iotd-test",
+		MetadataMsg{"temp": {Value: "20", Time: 1}, "name": {Value: 1234, Time: 1}})
+	assert.Nil(t, err)
+	assert.Equal(t, MetadataMsg{"temp": {Value: int32(20), Time: 1}, "name": {Value: "1234", Time: 1}}, dataEx)
+}
+
+func TestValidateEvent(t *testing.T) {
+	server := newTestModelServer()
+	defer server.Close()
+	v := newDataValidate(newTestSession(t, SetMetadataAddress(server.URL)), ValidateLenient, nil)
+	_, err := v.validateEvent(context.Background(), "iotd-test", "alarm", Metadata{"level": 2})
+	assert.Nil(t, err)
+	_, err = v.validateEvent(context.Background(), "iotd-test", "alarm", Metadata{"level": 4})
+	assert.IsType(t, &ValidationError{}, err)
+	_, err = v.validateEvent(context.Background(), "iotd-test", "alarm", Metadata{"other": 1})
+	assert.IsType(t, &ValidationError{}, err)
+	_, err = v.validateEvent(context.Background(), "iotd-test", "unknown", Metadata{})
+	assert.IsType(t, &ValidationError{}, err)
+}
+
+func TestValidateService(t *testing.T) {
+	server := newTestModelServer()
+	defer server.Close()
+	v := newDataValidate(newTestSession(t, SetMetadataAddress(server.URL)), ValidateCoerce, nil)
+	args, err := v.validateServiceInput(context.Background(), "iotd-test", "reboot", Metadata{"delay": "5"})
+	assert.Nil(t, err)
+	assert.Equal(t, Metadata{"delay": int32(5)}, args)
+	_, err = v.validateServiceInput(context.Background(), "iotd-test", "reboot", Metadata{"delay": "soon"})
+	assert.IsType(t, &ValidationError{}, err)
+	_, err = v.validateServiceInput(context.Background(), "iotd-test", "shutdown", Metadata{})
+	assert.Equal(t, NewServiceError(RpcUnsupported, "unknown service: shutdown"), err)
+	_, err = v.validateServiceOutput(context.Background(), "iotd-test", "reboot", Metadata{"ok": true})
+	assert.Nil(t, err)
+	_, err = v.validateServiceOutput(context.Background(), "iotd-test", "reboot", Metadata{"ok": "maybe"})
+	assert.IsType(t, &ValidationError{}, err)
+}
+
+//thing model in the metadata sub device response format, define and ext are base64 encoded json
+func TestThingModelFixture(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/child_device.json")
+	assert.Nil(t, err)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buf)
+	}))
+	defer server.Close()
+	session := newTestSession(t, SetMetadataAddress(server.URL))
+	deviceId := "iotd-6f1d5c2a-3b9e-4c1d-9a7e-2f8b1c0d4e5a"
+	thing, err := session.getModel(deviceId)
+	assert.Nil(t, err)
+	assert.Len(t, thing.Properties, 8)
+	assert.Equal(t, "ARRAY", thing.Properties["samples"].Type)
+	assert.Equal(t, 0.5, newChangeFilter(ChangeFilter{}, nil).setting(thing, "temp").Deadband)
+
+	validate := newDataValidate(session, ValidateStrict, nil)
+	params := Metadata{
+		"temp":     23.5,
+		"humidity": 40,
+		"name":     "room",
+		"mode":     1,
+		"power":    true,
+		"samples":  []interface{}{1, 2},
+		"location": map[string]interface{}{"lat": 30.5, "lng": 120.1},
+		"updated":  1600000000000,
+	}
+	data, err := validate.validateProperties(context.Background(), deviceId, params)
+	assert.Nil(t, err)
+	assert.Equal(t, params, data)
+
+	_, err = validate.validateProperties(context.Background(), deviceId, Metadata{
+		"temp":     23.55,
+		"humidity": 101,
+		"name":     "a name longer than sixteen",
+		"mode":     3,
+		"samples":  []interface{}{1, 2, 3, 1001},
+		"location": map[string]interface{}{"lat": 91},
+	})
+	validateErr, ok := err.(*ValidationError)
+	assert.True(t, ok)
+	if ok {
+		fields := make(map[string]bool)
+		for _, f := range validateErr.Fields {
+			fields[f.Field] = true
+		}
+		assert.Equal(t, map[string]bool{"temp": true, "humidity": true, "name": true, "mode": true,
+			"samples[3]": true, "location.lat": true}, fields)
+	}
+}